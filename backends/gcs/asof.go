@@ -0,0 +1,167 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package gcs
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/DomZippilli/gcs-proxy-cloud-function/common"
+
+	storage "cloud.google.com/go/storage"
+	cache "github.com/patrickmn/go-cache"
+	"google.golang.org/api/iterator"
+)
+
+// AuthorizeAsOf enables viewing sites as they were at a past time, and
+// decides who may do so. Each object is served at the generation that was
+// live at that time, so a page and everything it loads are consistent. This
+// needs a bucket with versioning enabled, and only sees as far back as the
+// noncurrent versions it keeps.
+//
+// A time is given in RFC 3339 format, either as a URL path prefix, e.g.,
+// /_asof/2026-05-01T12:00:00Z/index.html, or in an X-As-Of header. Requests
+// for other paths coming from a page in the view are redirected into it, so
+// links by absolute path stay in the view.
+//
+// The view is off when this is nil. For example, to only let requests with a
+// particular header through:
+//
+//	gcs.AuthorizeAsOf = func(request *http.Request) bool {
+//		return request.Header.Get("X-Audit-Token") == auditToken
+//	}
+var AuthorizeAsOf func(request *http.Request) bool
+
+// asOfPath is the URL path prefix that selects a time to view sites as of.
+const asOfPath = "/_asof/"
+
+// asOfHeader is the request header that selects a time to view sites as of.
+const asOfHeader = "X-As-Of"
+
+// asOfCacheControl is sent with everything served as of a past time. The
+// view is restricted, so it mustn't be kept by shared caches.
+const asOfCacheControl = "private, no-cache"
+
+var (
+	// errBadAsOf is returned for a time that can't be parsed.
+	errBadAsOf = errors.New("invalid as-of time")
+	// errAsOfForbidden is returned when AuthorizeAsOf refuses a request.
+	errAsOfForbidden = errors.New("as-of view not authorized")
+)
+
+// asOfGenerations caches which generation of an object was live at a time,
+// with 0 for none.
+var asOfGenerations = cache.New(10*time.Minute, 10*time.Minute)
+
+// asOfFor finds the time a request views sites as of, and the URL path
+// prefix that selected it, if any. A zero time is the live site.
+func asOfFor(request *http.Request) (asOf time.Time, view string, err error) {
+	if AuthorizeAsOf == nil {
+		return
+	}
+	var stamp string
+	if strings.HasPrefix(request.URL.Path, asOfPath) {
+		stamp, _, _ = strings.Cut(strings.TrimPrefix(request.URL.Path, asOfPath), "/")
+		view = asOfPath + stamp
+	} else if stamp = request.Header.Get(asOfHeader); stamp == "" {
+		return time.Time{}, "", asOfReferred(request)
+	}
+	asOf, err = time.Parse(time.RFC3339, stamp)
+	if err != nil {
+		return time.Time{}, "", errBadAsOf
+	}
+	if !AuthorizeAsOf(request) {
+		return time.Time{}, "", errAsOfForbidden
+	}
+	return asOf, view, nil
+}
+
+// varyAsOf tells caches that a response depends on the headers that select
+// a view, if views are on, so a live response isn't served for a view, nor
+// the reverse.
+func varyAsOf(header http.Header) {
+	if AuthorizeAsOf == nil {
+		return
+	}
+	common.AddVary(header, asOfHeader)
+	common.AddVary(header, "Referer")
+}
+
+// asOfReferred redirects a request made from a page in a view into the same
+// view. Pages often load assets by absolute path, which would otherwise be
+// served live.
+func asOfReferred(request *http.Request) error {
+	referer, err := url.Parse(request.Referer())
+	if err != nil || !strings.HasPrefix(referer.Path, asOfPath) ||
+		(referer.Host != "" && referer.Host != request.Host) {
+		return nil
+	}
+	stamp, _, _ := strings.Cut(strings.TrimPrefix(referer.Path, asOfPath), "/")
+	if _, err := time.Parse(time.RFC3339, stamp); err != nil ||
+		!AuthorizeAsOf(request) {
+		return nil
+	}
+	return &redirect{asOfPath + stamp + request.URL.RequestURI(),
+		http.StatusTemporaryRedirect}
+}
+
+// liveAt tells whether a generation of an object was live at a time.
+func liveAt(objectAttrs *storage.ObjectAttrs, t time.Time) bool {
+	return !objectAttrs.Created.After(t) &&
+		(objectAttrs.Deleted.IsZero() || objectAttrs.Deleted.After(t))
+}
+
+// resolve pins an object to the generation that was live when the site is
+// viewed as of. A missing object is ErrObjectNotExist. Objects already pinned
+// to a generation, and those in the live site, are left alone.
+func (s *site) resolve(ctx context.Context, ref objectRef) (objectRef, error) {
+	if s.asOf.IsZero() || ref.generation > 0 {
+		return ref, nil
+	}
+	key := s.cacheKey(ref)
+	if generation, hit := asOfGenerations.Get(key); hit {
+		ref.generation = generation.(int64)
+	} else {
+		query := &storage.Query{
+			Versions:    true,
+			StartOffset: ref.name,
+			EndOffset:   ref.name + "\x00",
+		}
+		query.SetAttrSelection([]string{"Name", "Generation", "Created",
+			"Deleted"})
+		it := s.bucket.Objects(ctx, query)
+		for {
+			objectAttrs, err := it.Next()
+			if err == iterator.Done {
+				break
+			}
+			if err != nil {
+				return ref, err
+			}
+			if objectAttrs.Name == ref.name && liveAt(objectAttrs, s.asOf) {
+				ref.generation = objectAttrs.Generation
+				break
+			}
+		}
+		asOfGenerations.Set(key, ref.generation, cache.DefaultExpiration)
+	}
+	if ref.generation == 0 {
+		return ref, storage.ErrObjectNotExist
+	}
+	return ref, nil
+}
@@ -0,0 +1,119 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package gcs
+
+import (
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/textproto"
+	"strings"
+	"time"
+
+	"github.com/DomZippilli/gcs-proxy-cloud-function/common"
+
+	storage "cloud.google.com/go/storage"
+)
+
+// objectETag makes a strong entity tag for an object. The MD5 hash is used
+// when there is one, so identical content re-uploaded keeps its tag; composite
+// objects have no MD5, so they fall back to the generation.
+func objectETag(objectAttrs *storage.ObjectAttrs) string {
+	if len(objectAttrs.MD5) > 0 {
+		return `"` + hex.EncodeToString(objectAttrs.MD5) + `"`
+	}
+	return fmt.Sprintf(`"g%d"`, objectAttrs.Generation)
+}
+
+// lastModified is the object's modification time at HTTP-date precision.
+func lastModified(objectAttrs *storage.ObjectAttrs) time.Time {
+	return objectAttrs.Updated.UTC().Truncate(time.Second)
+}
+
+// checkPreconditions evaluates the conditional request headers against the
+// object, in the order given by RFC 7232 section 6. A zero status means the
+// request should proceed; otherwise, it is 304 Not Modified or 412
+// Precondition Failed, and should be answered without the object's media.
+func checkPreconditions(request *http.Request, objectAttrs *storage.ObjectAttrs) int {
+	etag := objectETag(objectAttrs)
+	modified := lastModified(objectAttrs)
+	safe := request.Method == http.MethodGet || request.Method == http.MethodHead
+
+	// the client's copy must be current
+	if im := request.Header.Get("If-Match"); im != "" {
+		if !etagListMatch(im, etag, false) {
+			return http.StatusPreconditionFailed
+		}
+	} else if ius := request.Header.Get("If-Unmodified-Since"); ius != "" {
+		if t, err := http.ParseTime(ius); err == nil && modified.After(t) {
+			return http.StatusPreconditionFailed
+		}
+	}
+
+	// the client's copy must be stale
+	if inm := request.Header.Get("If-None-Match"); inm != "" {
+		if etagListMatch(inm, etag, true) {
+			if safe {
+				return http.StatusNotModified
+			}
+			return http.StatusPreconditionFailed
+		}
+	} else if ims := request.Header.Get("If-Modified-Since"); ims != "" && safe {
+		if t, err := http.ParseTime(ims); err == nil && !modified.After(t) {
+			return http.StatusNotModified
+		}
+	}
+	return 0
+}
+
+// writePrecondition answers a request whose preconditions were not met.
+func writePrecondition(response http.ResponseWriter, request *http.Request,
+	status int) {
+	if status == http.StatusNotModified {
+		// a 304 carries validators and caching headers, but no representation
+		// metadata, per RFC 7232 section 4.1
+		header := response.Header()
+		header.Del("Content-Type")
+		header.Del("Content-Length")
+		header.Del("Content-Encoding")
+		header.Del("Accept-Ranges")
+		response.WriteHeader(status)
+		return
+	}
+	clearObjectHeaders(response.Header())
+	common.Error(response, request, "", status)
+}
+
+// etagListMatch tells whether etag is in a list of entity tags from an
+// If-Match or If-None-Match header. "*" matches any tag. Weak comparison
+// ignores the W/ prefix; strong comparison never matches a weak tag.
+func etagListMatch(list string, etag string, weak bool) bool {
+	list = textproto.TrimString(list)
+	if list == "*" {
+		return true
+	}
+	for _, candidate := range strings.Split(list, ",") {
+		candidate = textproto.TrimString(candidate)
+		if strings.HasPrefix(candidate, "W/") {
+			if !weak {
+				continue
+			}
+			candidate = candidate[2:]
+		}
+		if candidate == etag {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,181 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package gcs
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	storage "cloud.google.com/go/storage"
+)
+
+func TestCheckPreconditions(t *testing.T) {
+	updated := time.Date(2021, 5, 1, 12, 0, 0, 0, time.UTC)
+	objectAttrs := &storage.ObjectAttrs{
+		MD5:     []byte{0xab, 0xcd},
+		Updated: updated.Add(500 * time.Millisecond),
+	}
+	const etag = `"abcd"`
+	before := updated.Add(-time.Hour).Format(http.TimeFormat)
+	at := updated.Format(http.TimeFormat)
+	tests := []struct {
+		name   string
+		method string
+		header http.Header
+		want   int
+	}{
+		{"none", http.MethodGet, http.Header{}, 0},
+
+		// If-Match compares strongly
+		{"if-match", http.MethodGet, http.Header{"If-Match": {etag}}, 0},
+		{"if-match list", http.MethodPut,
+			http.Header{"If-Match": {`"1234", ` + etag}}, 0},
+		{"if-match other", http.MethodGet, http.Header{"If-Match": {`"1234"`}},
+			http.StatusPreconditionFailed},
+		{"if-match weak", http.MethodGet, http.Header{"If-Match": {"W/" + etag}},
+			http.StatusPreconditionFailed},
+		{"if-match star", http.MethodPut, http.Header{"If-Match": {"*"}}, 0},
+
+		// If-Unmodified-Since only counts without If-Match
+		{"if-unmodified-since", http.MethodGet,
+			http.Header{"If-Unmodified-Since": {at}}, 0},
+		{"if-unmodified-since before", http.MethodGet,
+			http.Header{"If-Unmodified-Since": {before}},
+			http.StatusPreconditionFailed},
+		{"if-unmodified-since with if-match", http.MethodGet,
+			http.Header{"If-Match": {etag}, "If-Unmodified-Since": {before}}, 0},
+		{"if-unmodified-since garbage", http.MethodGet,
+			http.Header{"If-Unmodified-Since": {"yesterday"}}, 0},
+
+		// If-None-Match compares weakly, and is a 304 only for GET and HEAD
+		{"if-none-match get", http.MethodGet,
+			http.Header{"If-None-Match": {etag}}, http.StatusNotModified},
+		{"if-none-match head", http.MethodHead,
+			http.Header{"If-None-Match": {etag}}, http.StatusNotModified},
+		{"if-none-match weak", http.MethodGet,
+			http.Header{"If-None-Match": {"W/" + etag}}, http.StatusNotModified},
+		{"if-none-match put", http.MethodPut,
+			http.Header{"If-None-Match": {etag}}, http.StatusPreconditionFailed},
+		{"if-none-match star get", http.MethodGet,
+			http.Header{"If-None-Match": {"*"}}, http.StatusNotModified},
+		{"if-none-match star put", http.MethodPut,
+			http.Header{"If-None-Match": {"*"}}, http.StatusPreconditionFailed},
+		{"if-none-match other", http.MethodGet,
+			http.Header{"If-None-Match": {`"1234", W/"5678"`}}, 0},
+
+		// If-Modified-Since only counts without If-None-Match, for GET and HEAD
+		{"if-modified-since", http.MethodGet,
+			http.Header{"If-Modified-Since": {at}}, http.StatusNotModified},
+		{"if-modified-since before", http.MethodGet,
+			http.Header{"If-Modified-Since": {before}}, 0},
+		{"if-modified-since put", http.MethodPut,
+			http.Header{"If-Modified-Since": {at}}, 0},
+		{"if-modified-since with if-none-match", http.MethodGet,
+			http.Header{"If-None-Match": {`"1234"`}, "If-Modified-Since": {at}},
+			0},
+
+		// If-Match is evaluated before If-None-Match
+		{"if-match fails first", http.MethodGet,
+			http.Header{"If-Match": {`"1234"`}, "If-None-Match": {etag}},
+			http.StatusPreconditionFailed},
+		{"if-match then if-none-match", http.MethodGet,
+			http.Header{"If-Match": {etag}, "If-None-Match": {etag}},
+			http.StatusNotModified},
+	}
+	for _, tc := range tests {
+		request, _ := http.NewRequest(tc.method, "/object", nil)
+		request.Header = tc.header
+		if got := checkPreconditions(request, objectAttrs); got != tc.want {
+			t.Errorf("%s: checkPreconditions = %d; want %d", tc.name, got,
+				tc.want)
+		}
+	}
+}
+
+func TestEtagListMatch(t *testing.T) {
+	tests := []struct {
+		list string
+		etag string
+		weak bool
+		want bool
+	}{
+		{`"a"`, `"a"`, false, true},
+		{` "b" , "a" `, `"a"`, false, true},
+		{`"b"`, `"a"`, false, false},
+		{`W/"a"`, `"a"`, false, false},
+		{`W/"a"`, `"a"`, true, true},
+		{`*`, `"a"`, false, true},
+		{` * `, `"a"`, true, true},
+		{`"a`, `"a"`, true, false},
+	}
+	for _, tc := range tests {
+		if got := etagListMatch(tc.list, tc.etag, tc.weak); got != tc.want {
+			t.Errorf("etagListMatch(%q, %q, %v) = %v; want %v", tc.list,
+				tc.etag, tc.weak, got, tc.want)
+		}
+	}
+}
+
+func TestWritePrecondition(t *testing.T) {
+	objectHeaders := func() http.Header {
+		return http.Header{
+			"Accept-Ranges":    {"bytes"},
+			"Cache-Control":    {"public, max-age=60"},
+			"Content-Encoding": {"gzip"},
+			"Content-Length":   {"1000"},
+			"Content-Type":     {"text/html"},
+			"Etag":             {`"abcd"`},
+			"Last-Modified":    {"Sat, 01 May 2021 12:00:00 GMT"},
+		}
+	}
+	tests := []struct {
+		status int
+		kept   []string
+		gone   []string
+	}{
+		// a 304 keeps validators and caching headers
+		{http.StatusNotModified,
+			[]string{"Cache-Control", "Etag", "Last-Modified"},
+			[]string{"Accept-Ranges", "Content-Encoding", "Content-Length",
+				"Content-Type"}},
+		// a 412 says nothing about the object
+		{http.StatusPreconditionFailed,
+			[]string{"Cache-Control"},
+			[]string{"Accept-Ranges", "Content-Encoding", "Content-Length",
+				"Etag", "Last-Modified"}},
+	}
+	for _, tc := range tests {
+		request, _ := http.NewRequest(http.MethodGet, "/object", nil)
+		recorder := httptest.NewRecorder()
+		for name, values := range objectHeaders() {
+			recorder.Header()[name] = values
+		}
+		writePrecondition(recorder, request, tc.status)
+		if recorder.Code != tc.status {
+			t.Errorf("writePrecondition(%d) sent %d", tc.status, recorder.Code)
+		}
+		for _, name := range tc.kept {
+			if recorder.Header().Get(name) == "" {
+				t.Errorf("writePrecondition(%d) dropped %s", tc.status, name)
+			}
+		}
+		for _, name := range tc.gone {
+			if got := recorder.Header().Get(name); got != "" {
+				t.Errorf("writePrecondition(%d) kept %s: %q", tc.status, name, got)
+			}
+		}
+	}
+}
@@ -0,0 +1,145 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package gcs
+
+import (
+	"context"
+	"io"
+	"mime"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+
+	storage "cloud.google.com/go/storage"
+	cache "github.com/patrickmn/go-cache"
+	"github.com/rs/zerolog/log"
+)
+
+// ContentTypes maps file extensions, in lower case with the dot, to the
+// content types served for objects stored without a useful one: none, or
+// application/octet-stream. Extensions not here are looked up with
+// mime.TypeByExtension.
+var ContentTypes = map[string]string{
+	".html":        "text/html; charset=utf-8",
+	".htm":         "text/html; charset=utf-8",
+	".css":         "text/css; charset=utf-8",
+	".js":          "text/javascript; charset=utf-8",
+	".mjs":         "text/javascript; charset=utf-8",
+	".json":        "application/json",
+	".map":         "application/json",
+	".webmanifest": "application/manifest+json",
+	".txt":         "text/plain; charset=utf-8",
+	".md":          "text/markdown; charset=utf-8",
+	".csv":         "text/csv; charset=utf-8",
+	".xml":         "application/xml",
+	".svg":         "image/svg+xml",
+	".png":         "image/png",
+	".jpg":         "image/jpeg",
+	".jpeg":        "image/jpeg",
+	".gif":         "image/gif",
+	".webp":        "image/webp",
+	".avif":        "image/avif",
+	".ico":         "image/x-icon",
+	".woff":        "font/woff",
+	".woff2":       "font/woff2",
+	".ttf":         "font/ttf",
+	".otf":         "font/otf",
+	".wasm":        "application/wasm",
+	".pdf":         "application/pdf",
+	".mp4":         "video/mp4",
+	".webm":        "video/webm",
+	".mp3":         "audio/mpeg",
+}
+
+// SniffContentTypes enables guessing the content type of objects stored
+// without a useful one, and with an extension that isn't known, from their
+// first 512 bytes, as http.DetectContentType does. Each object is only
+// sniffed once, until it changes.
+var SniffContentTypes = false
+
+// sniffLength is how much of an object is read to sniff its type.
+const sniffLength = 512
+
+// sniffedTypes caches sniffed content types, by object and entity tag, with
+// "" for objects that couldn't be sniffed.
+var sniffedTypes = cache.New(10*time.Minute, 10*time.Minute)
+
+// genericContentType tells whether a stored content type says nothing about
+// the content.
+func genericContentType(contentType string) bool {
+	mediaType, _, _ := strings.Cut(contentType, ";")
+	switch strings.ToLower(strings.TrimSpace(mediaType)) {
+	case "", "application/octet-stream", "binary/octet-stream":
+		return true
+	}
+	return false
+}
+
+// contentTypeFor finds the content type to serve an object with, and whether
+// it is authoritative, so browsers shouldn't second-guess it. That is the
+// stored type, unless it is generic, in which case it is worked out from the
+// object's extension, or, failing that, sniffed, if SniffContentTypes is on.
+// A sniffed type is only a guess. Empty objects and redirects aren't sniffed.
+func contentTypeFor(ctx context.Context, s *site, ref objectRef,
+	objectAttrs *storage.ObjectAttrs) (contentType string, authoritative bool) {
+	if !genericContentType(objectAttrs.ContentType) {
+		return objectAttrs.ContentType, true
+	}
+	ext := strings.ToLower(path.Ext(ref.name))
+	if contentType, ok := ContentTypes[ext]; ok {
+		return contentType, true
+	}
+	if contentType := mime.TypeByExtension(ext); ext != "" && contentType != "" {
+		return contentType, true
+	}
+	// there is nothing to sniff in an empty object, like a redirect
+	if SniffContentTypes && objectAttrs.ContentEncoding == "" &&
+		objectAttrs.Size > 0 && metadataValue(objectAttrs, redirectToKey) == "" {
+		if contentType := sniffContentType(ctx, s, ref, objectAttrs); contentType != "" {
+			return contentType, false
+		}
+	}
+	return objectAttrs.ContentType, false
+}
+
+// sniffContentType guesses an object's content type from its first bytes, or
+// returns "" if it can't tell.
+func sniffContentType(ctx context.Context, s *site, ref objectRef,
+	objectAttrs *storage.ObjectAttrs) string {
+	key := s.cacheKey(ref) + "|" + objectETag(objectAttrs)
+	if contentType, hit := sniffedTypes.Get(key); hit {
+		return contentType.(string)
+	}
+	var contentType string
+	reader, err := s.handle(ref).NewRangeReader(ctx, 0, sniffLength)
+	if err == nil {
+		defer reader.Close()
+		var head []byte
+		head, err = io.ReadAll(reader)
+		if err == nil && len(head) > 0 {
+			contentType = http.DetectContentType(head)
+		}
+	}
+	if err != nil {
+		// try again next time
+		log.Warn().Msgf("sniff %v: %v", ref.name, err)
+		return ""
+	}
+	if genericContentType(contentType) {
+		contentType = ""
+	}
+	sniffedTypes.Set(key, contentType, cache.DefaultExpiration)
+	return contentType
+}
@@ -0,0 +1,144 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package gcs
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/DomZippilli/gcs-proxy-cloud-function/common"
+	"github.com/DomZippilli/gcs-proxy-cloud-function/filter"
+
+	storage "cloud.google.com/go/storage"
+	"github.com/rs/zerolog/log"
+)
+
+// AcceptDeletes lets Delete delete objects, once DELETE is allowed in
+// proxy.AllowedMethods. Tus terminates uploads without either.
+var AcceptDeletes = false
+
+// Delete removes the object the URL maps to, or the generation of it given by
+// the "generation" query parameter. The response is a 204, or a 404 if there
+// is no such object.
+//
+// If-Match is checked against the object's ETag, and
+// X-Goog-If-Generation-Match against its generation; if either doesn't
+// match, nothing is deleted and the response is a 412. If-Match on a missing
+// object is a 412, too. The object is then only deleted if it is still the
+// generation that was checked.
+//
+// Once deleted, the object's metadata and media are dropped from the caches
+// of every site serving it. cacheDelete removes media from the cache that
+// ReadWithCache is given.
+//
+// Unless AcceptDeletes is on, the response is a 405.
+//
+// The pipeline is applied to the (empty) response body.
+func Delete(ctx context.Context, response http.ResponseWriter,
+	request *http.Request, pipeline filter.Pipeline, cacheDelete CacheDelete) {
+	if !AcceptDeletes {
+		methodNotAllowed(response, request, nil)
+		return
+	}
+	s, err := siteFor(request)
+	if err != nil {
+		writeObjectError(ctx, response, request, s, err, pipeline)
+		return
+	}
+	if !s.asOf.IsZero() {
+		// the past can't be changed
+		methodNotAllowed(response, request, s)
+		return
+	}
+	if isTusState(s.path(request.URL.Path)) {
+		// uploads in progress are managed by Tus
+		common.Error(response, request, "", http.StatusForbidden)
+		return
+	}
+	generation, err := queryGeneration(request)
+	if err != nil {
+		common.Error(response, request, "", http.StatusBadRequest)
+		return
+	}
+	website := websiteFor(ctx, s.ownBucket, s.bucketName)
+	ref := objectRef{s.objectName(s.path(request.URL.Path),
+		mainPageSuffix(website)), generation}
+	objectHandle := s.handle(ref)
+
+	// check preconditions against the object as it is now, not as cached
+	im := request.Header.Get("If-Match")
+	gm := request.Header.Get(generationMatchHeader)
+	if im != "" || gm != "" {
+		objectAttrs, err := objectHandle.Attrs(ctx)
+		if err == storage.ErrObjectNotExist && im != "" {
+			// If-Match fails when there's nothing to match
+			common.Error(response, request, "", http.StatusPreconditionFailed)
+			return
+		}
+		if err != nil {
+			writeGoogleAPIError(response, request, err)
+			return
+		}
+		if im != "" && !etagListMatch(im, objectETag(objectAttrs), false) {
+			common.Error(response, request, "", http.StatusPreconditionFailed)
+			return
+		}
+		if gm != "" {
+			matchGeneration, err := strconv.ParseInt(gm, 10, 64)
+			if err != nil {
+				common.Error(response, request, "", http.StatusBadRequest)
+				return
+			}
+			if matchGeneration != objectAttrs.Generation {
+				common.Error(response, request, "", http.StatusPreconditionFailed)
+				return
+			}
+		}
+		// don't delete a newer generation than the one checked
+		if generation == 0 {
+			objectHandle = objectHandle.If(storage.Conditions{
+				GenerationMatch: objectAttrs.Generation,
+			})
+		}
+		forgetObject(s, objectRef{ref.name, objectAttrs.Generation}, cacheDelete)
+	}
+
+	err = objectHandle.Delete(ctx)
+	forgetObject(s, ref, cacheDelete)
+	if generation > 0 {
+		// it may have been the live generation, cached by name alone
+		forgetObject(s, objectRef{name: ref.name}, cacheDelete)
+	}
+	if err != nil {
+		writeGoogleAPIError(response, request, err)
+		return
+	}
+	response.WriteHeader(http.StatusNoContent)
+
+	// send the (empty) body
+	media := strings.NewReader("")
+	if len(pipeline) > 0 {
+		// use a filter pipeline
+		_, err = filter.PipelineCopy(ctx, response, media, request, pipeline)
+	} else {
+		// unfiltered, simple copy
+		_, err = io.Copy(response, media)
+	}
+	if err != nil {
+		log.Error().Msgf("Delete: %v", err)
+	}
+}
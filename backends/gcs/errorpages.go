@@ -0,0 +1,167 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package gcs
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	storage "cloud.google.com/go/storage"
+	cache "github.com/patrickmn/go-cache"
+	"github.com/rs/zerolog/log"
+)
+
+// ErrorPage is a page sent with an error status code, in place of the bare
+// status text. It is either an object from the bucket, or a template.
+type ErrorPage struct {
+	// Object is the name of an object to serve, relative to the prefix of the
+	// site (see Hosts and Mounts) serving the request.
+	Object string
+	// Template is executed with errorPageData, if there is no Object.
+	Template *template.Template
+}
+
+// errorPageData is what an ErrorPage's Template is executed with.
+type errorPageData struct {
+	StatusCode int
+	StatusText string
+	Path       string
+}
+
+// ErrorPages maps status codes to the pages sent with them. Without a page for
+// 404, the bucket's website NotFoundPage is used, if it has one.
+//
+// For example:
+//
+//	gcs.ErrorPages = map[int]gcs.ErrorPage{
+//		http.StatusNotFound: {Object: "errors/404.html"},
+//	}
+var ErrorPages = map[int]ErrorPage{}
+
+// ErrorPagesByPrefix overrides ErrorPages for URL paths under a prefix, e.g.,
+// "/docs/". The longest matching prefix with a page for the status code wins.
+var ErrorPagesByPrefix = map[string]map[int]ErrorPage{}
+
+// errorPageMedia caches the media of error page objects, by cache key and
+// ETag, so errors don't each read the page from GCS.
+var errorPageMedia = cache.New(10*time.Minute, 10*time.Minute)
+
+// maxCachedErrorPage is the size of the largest error page object cached.
+const maxCachedErrorPage = 1 << 20
+
+// errorPageFor finds the error page for a status code and URL path.
+func errorPageFor(statusCode int, urlPath string) (page ErrorPage, ok bool) {
+	longest := -1
+	for prefix, pages := range ErrorPagesByPrefix {
+		if !strings.HasPrefix(urlPath, prefix) || len(prefix) <= longest {
+			continue
+		}
+		if p, found := pages[statusCode]; found {
+			page, ok, longest = p, true, len(prefix)
+		}
+	}
+	if !ok {
+		page, ok = ErrorPages[statusCode]
+	}
+	return
+}
+
+// writeErrorPage sends the configured error page for a status code. It
+// matches the common.ErrorPageWriter type.
+func writeErrorPage(response http.ResponseWriter, request *http.Request,
+	statusCode int) bool {
+	s, err := siteFor(request)
+	if err != nil {
+		return false
+	}
+	page, ok := errorPageFor(statusCode,
+		strings.TrimPrefix(request.URL.Path, s.view))
+	if !ok && statusCode == http.StatusNotFound {
+		// use the bucket's own website not found page, as GCS would
+		website := websiteFor(request.Context(), s.ownBucket, s.bucketName)
+		page, ok = ErrorPage{Object: website.NotFoundPage}, website.NotFoundPage != ""
+	}
+	if !ok {
+		return false
+	}
+
+	// get the page, or give up and let a plain error be sent
+	media := new(bytes.Buffer)
+	contentType := "text/html; charset=utf-8"
+	if page.Object != "" {
+		ctx := request.Context()
+		ref, err := s.resolve(ctx, objectRef{name: s.prefix + page.Object})
+		var objectAttrs *storage.ObjectAttrs
+		if err == nil {
+			objectAttrs, err = getAttrs(ctx, s, ref)
+		}
+		if err != nil {
+			log.Error().Msgf("error page %v: %v", page.Object, err)
+			return false
+		}
+		key := s.cacheKey(ref) + "|" + objectETag(objectAttrs)
+		if cached, hit := errorPageMedia.Get(key); hit {
+			media.Write(cached.([]byte))
+		} else {
+			objectContent, err := s.handle(ref).NewReader(ctx)
+			if err != nil {
+				log.Error().Msgf("error page %v: %v", page.Object, err)
+				return false
+			}
+			defer objectContent.Close()
+			if _, err := io.Copy(media, objectContent); err != nil {
+				log.Error().Msgf("error page %v: %v", page.Object, err)
+				return false
+			}
+			if media.Len() <= maxCachedErrorPage {
+				errorPageMedia.SetDefault(key, media.Bytes())
+			}
+		}
+		if objectAttrs.ContentType != "" {
+			contentType = objectAttrs.ContentType
+		}
+	} else if page.Template != nil {
+		err := page.Template.Execute(media, errorPageData{
+			StatusCode: statusCode,
+			StatusText: http.StatusText(statusCode),
+			Path:       request.URL.Path,
+		})
+		if err != nil {
+			log.Error().Msgf("error page %v: %v", page.Template.Name(), err)
+			return false
+		}
+	} else {
+		return false
+	}
+
+	// headers for whatever was meant to be served no longer apply
+	header := response.Header()
+	contentRange := header.Get("Content-Range")
+	clearObjectHeaders(header)
+	header.Del("Cache-Control")
+	if statusCode == http.StatusRequestedRangeNotSatisfiable && contentRange != "" {
+		// the client still needs to know the size (RFC 7233, section 4.4)
+		header.Set("Content-Range", contentRange)
+	}
+	header.Set("Content-Type", contentType)
+	header.Set("Content-Length", fmt.Sprint(media.Len()))
+	response.WriteHeader(statusCode)
+	io.Copy(response, media)
+	return true
+}
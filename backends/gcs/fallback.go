@@ -0,0 +1,66 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package gcs
+
+import (
+	"path"
+	"regexp"
+	"strings"
+)
+
+// SPAFallback serves a designated object in place of ones that don't exist,
+// so that client-side routes in a single page app can be deep linked.
+//
+// For example, this serves app/index.html for /app/settings, but a missing
+// /app/logo.png is still a 404:
+//
+//	gcs.SPAFallbacks = []gcs.SPAFallback{
+//		{Prefix: "/app/", Object: "app/index.html"},
+//	}
+type SPAFallback struct {
+	// Prefix limits the fallback to URL paths under it.
+	Prefix string
+	// Match selects which missing URL paths fall back. If nil, paths whose
+	// last segment has no file extension match.
+	Match *regexp.Regexp
+	// Object is the name of the object to serve instead, relative to the
+	// prefix of the site (see Hosts and Mounts) serving the request.
+	Object string
+}
+
+// SPAFallbacks are tried in order when the object for a request doesn't exist.
+// The first that matches the URL path is served, with a 200.
+var SPAFallbacks []SPAFallback
+
+// matches tells whether a missing URL path should fall back.
+func (f SPAFallback) matches(urlPath string) bool {
+	if !strings.HasPrefix(urlPath, f.Prefix) {
+		return false
+	}
+	if f.Match != nil {
+		return f.Match.MatchString(urlPath)
+	}
+	return path.Ext(path.Base(urlPath)) == ""
+}
+
+// fallbackFor returns the name of the object to serve in place of the missing
+// object for a URL path, if any.
+func fallbackFor(urlPath string) (string, bool) {
+	for _, f := range SPAFallbacks {
+		if f.matches(urlPath) {
+			return f.Object, true
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,321 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package gcs
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/DomZippilli/gcs-proxy-cloud-function/common"
+	"github.com/DomZippilli/gcs-proxy-cloud-function/filter"
+
+	"github.com/rs/zerolog/log"
+)
+
+// FormPolicy limits what a browser form may upload with FormUpload.
+type FormPolicy struct {
+	// Prefix is what the names of uploaded objects must start with, relative
+	// to the prefix of the site (see Hosts and Mounts).
+	Prefix string `json:"prefix"`
+	// ContentType is the type uploads must have, like "image/png", or a type
+	// ending in "/", like "image/", to allow all its subtypes. Empty allows
+	// any type.
+	ContentType string `json:"contentType,omitempty"`
+	// MaxSize is the largest upload allowed, in bytes.
+	MaxSize int64 `json:"maxSize"`
+	// Expires is when the policy stops being accepted. If zero, it is set to
+	// FormPolicyTTL from when it is issued.
+	Expires time.Time `json:"expires"`
+}
+
+// FormPolicies decides what policy, if any, to issue for a request to
+// FormPolicyPath. This is where to check who is asking, and what they may
+// upload. Policies are signed with the POLICY_SECRET environment variable.
+//
+// Form uploads are off when this is nil. For example, to let signed in users
+// upload images to a directory of their own:
+//
+//	gcs.FormPolicies = func(request *http.Request) (gcs.FormPolicy, bool) {
+//		user, ok := signedInUser(request)
+//		return gcs.FormPolicy{
+//			Prefix:      "uploads/" + user + "/",
+//			ContentType: "image/",
+//			MaxSize:     10 << 20,
+//		}, ok
+//	}
+var FormPolicies func(request *http.Request) (FormPolicy, bool)
+
+// FormPolicyPath is the URL path, within a site, where policies are issued.
+var FormPolicyPath = "/_policy"
+
+// FormPolicyTTL is how long a policy lasts, if FormPolicies doesn't say.
+var FormPolicyTTL = 15 * time.Minute
+
+// formPolicySecret signs policies. It is set from POLICY_SECRET in Setup.
+var formPolicySecret []byte
+
+// maxFormField is the largest form field, other than the file, accepted with
+// an upload.
+const maxFormField = 64 << 10
+
+// maxFormOverhead is how much more than a policy's MaxSize a form upload
+// request may be, to allow for the other fields and multipart encoding.
+const maxFormOverhead = 1 << 20
+
+// signedFormPolicy is a policy as issued: encoded, signed, and bound to the
+// site it was issued for.
+type signedFormPolicy struct {
+	FormPolicy
+	Site string `json:"site"`
+}
+
+// formPolicyResponse is sent by IssueFormPolicy. The fields go in the form,
+// along with a "key" field naming the object and a "file" field.
+type formPolicyResponse struct {
+	URL    string            `json:"url"`
+	Fields map[string]string `json:"fields"`
+}
+
+// errBadPolicy is returned for a policy that is missing, or wasn't issued by
+// this proxy.
+var errBadPolicy = errors.New("invalid form policy")
+
+// signFormPolicy signs an encoded policy.
+func signFormPolicy(encoded string) string {
+	mac := hmac.New(sha256.New, formPolicySecret)
+	mac.Write([]byte(encoded))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// IssueFormPolicy answers GET and POST requests to FormPolicyPath with a
+// signed policy from FormPolicies, as JSON, or a 403 if it refuses. It returns
+// false for other requests, which should be routed as usual.
+func IssueFormPolicy(ctx context.Context, response http.ResponseWriter,
+	request *http.Request) bool {
+	if FormPolicies == nil || (request.Method != http.MethodGet &&
+		request.Method != http.MethodPost) {
+		return false
+	}
+	s, err := siteFor(request)
+	if err != nil || s.path(request.URL.Path) != FormPolicyPath {
+		return false
+	}
+	policy, ok := FormPolicies(request)
+	if !ok {
+		common.Error(response, request, "", http.StatusForbidden)
+		return true
+	}
+	if policy.Expires.IsZero() {
+		policy.Expires = time.Now().Add(FormPolicyTTL)
+	}
+	b, err := json.Marshal(signedFormPolicy{policy, s.key()})
+	if err != nil {
+		log.Error().Msgf("form policy: %v", err)
+		common.Error(response, request, "", http.StatusInternalServerError)
+		return true
+	}
+	encoded := base64.RawURLEncoding.EncodeToString(b)
+	response.Header().Set("Content-Type", "application/json")
+	response.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(response).Encode(formPolicyResponse{
+		URL: s.url("/" + policy.Prefix),
+		Fields: map[string]string{
+			"policy":    encoded,
+			"signature": signFormPolicy(encoded),
+		},
+	})
+	return true
+}
+
+// verifyFormPolicy checks the signature on a policy, and that it was issued
+// for the site and hasn't expired.
+func verifyFormPolicy(s *site, encoded string, signature string) (FormPolicy,
+	error) {
+	if encoded == "" || !hmac.Equal([]byte(signature),
+		[]byte(signFormPolicy(encoded))) {
+		return FormPolicy{}, errBadPolicy
+	}
+	b, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return FormPolicy{}, errBadPolicy
+	}
+	var policy signedFormPolicy
+	if err := json.Unmarshal(b, &policy); err != nil || policy.Site != s.key() {
+		return FormPolicy{}, errBadPolicy
+	}
+	if time.Now().After(policy.Expires) {
+		return FormPolicy{}, errBadPolicy
+	}
+	return policy.FormPolicy, nil
+}
+
+// allowsType tells whether a policy allows uploads of a content type.
+func (p FormPolicy) allowsType(contentType string) bool {
+	if p.ContentType == "" {
+		return true
+	}
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	if strings.HasSuffix(p.ContentType, "/") {
+		return strings.HasPrefix(mediaType, p.ContentType)
+	}
+	return mediaType == p.ContentType
+}
+
+// FormUpload answers multipart/form-data POST requests from browser forms,
+// writing the file in the form to the bucket, if a policy from
+// IssueFormPolicy allows it. It returns false for other requests, which
+// should be routed as usual.
+//
+// The form has these fields, with the file last:
+//
+//   - policy and signature, as issued
+//   - key, the name of the object relative to the site's prefix, which must
+//     start with the policy's Prefix. "${filename}" in it is replaced with
+//     the name of the file.
+//   - Content-Type, optionally, to override the type the browser gives
+//   - file, the file to upload
+//
+// Uploads that don't match the policy are refused before anything is
+// written: a 403 for a bad policy, type, or name, which may not be a rules
+// file (see RulesFromBucket), and a 413 for a file that's too big. The
+// response to a successful upload is a 201, as with Write.
+func FormUpload(ctx context.Context, response http.ResponseWriter,
+	request *http.Request, pipeline filter.Pipeline,
+	cacheDelete CacheDelete) bool {
+	if FormPolicies == nil || request.Method != http.MethodPost {
+		return false
+	}
+	mediaType, params, err := mime.ParseMediaType(request.Header.Get("Content-Type"))
+	if err != nil || mediaType != "multipart/form-data" {
+		return false
+	}
+	s, err := siteFor(request)
+	if err != nil {
+		writeObjectError(ctx, response, request, s, err, pipeline)
+		return true
+	}
+	if !s.asOf.IsZero() {
+		// the past can't be changed
+		methodNotAllowed(response, request, s)
+		return true
+	}
+
+	// read the fields, up to the file
+	reader := multipart.NewReader(request.Body, params["boundary"])
+	fields := map[string]string{}
+	var file *multipart.Part
+	for file == nil {
+		part, err := reader.NextPart()
+		if err != nil {
+			// no file
+			common.Error(response, request, "", http.StatusBadRequest)
+			return true
+		}
+		if part.FormName() == "file" {
+			file = part
+			break
+		}
+		value, err := io.ReadAll(io.LimitReader(part, maxFormField+1))
+		if err != nil || len(value) > maxFormField {
+			common.Error(response, request, "", http.StatusBadRequest)
+			return true
+		}
+		fields[part.FormName()] = string(value)
+	}
+
+	// check the upload against the policy
+	policy, err := verifyFormPolicy(s, fields["policy"], fields["signature"])
+	if err != nil {
+		common.Error(response, request, "", http.StatusForbidden)
+		return true
+	}
+	key := strings.ReplaceAll(fields["key"], "${filename}",
+		path.Base("/"+file.FileName()))
+	name := strings.TrimPrefix(path.Clean("/"+key), "/")
+	if key == "" || isDirectory(key) || !strings.HasPrefix(name, policy.Prefix) ||
+		isTusState(name) || isRulesFile(name) {
+		common.Error(response, request, "", http.StatusForbidden)
+		return true
+	}
+	contentType := fields["Content-Type"]
+	if contentType == "" {
+		contentType = file.Header.Get("Content-Type")
+	}
+	if !policy.allowsType(contentType) {
+		common.Error(response, request, "", http.StatusForbidden)
+		return true
+	}
+	if request.ContentLength > policy.MaxSize+maxFormOverhead {
+		common.Error(response, request, "", http.StatusRequestEntityTooLarge)
+		return true
+	}
+
+	// stream the file to GCS. Cancelling the context abandons the write.
+	ref := objectRef{name: s.prefix + name}
+	writeCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	writer := s.handle(ref).NewWriter(writeCtx)
+	writer.ContentType = contentType
+	written, err := io.Copy(writer, io.LimitReader(file, policy.MaxSize+1))
+	if err != nil || written > policy.MaxSize {
+		cancel()
+		writer.Close()
+		if err != nil {
+			log.Error().Msgf("form upload %v: %v", ref.name, err)
+			common.Error(response, request, "", http.StatusBadRequest)
+		} else {
+			common.Error(response, request, "", http.StatusRequestEntityTooLarge)
+		}
+		return true
+	}
+	err = writer.Close()
+	forgetObject(s, ref, cacheDelete)
+	if err != nil {
+		writeGoogleAPIError(response, request, err)
+		return true
+	}
+	objectAttrs := writer.Attrs()
+	response.Header().Set("ETag", objectETag(objectAttrs))
+	response.Header().Set("X-Goog-Generation", fmt.Sprint(objectAttrs.Generation))
+	response.WriteHeader(http.StatusCreated)
+
+	// send the (empty) body
+	media := strings.NewReader("")
+	if len(pipeline) > 0 {
+		// use a filter pipeline
+		_, err = filter.PipelineCopy(ctx, response, media, request, pipeline)
+	} else {
+		// unfiltered, simple copy
+		_, err = io.Copy(response, media)
+	}
+	if err != nil {
+		log.Error().Msgf("FormUpload: %v", err)
+	}
+	return true
+}
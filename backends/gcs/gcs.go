@@ -15,18 +15,37 @@ package gcs
 
 import (
 	"context"
+	"errors"
 	"os"
 
+	"github.com/DomZippilli/gcs-proxy-cloud-function/common"
+
 	storage "cloud.google.com/go/storage"
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
 )
 
+// bucket is the default bucket, served for hosts not in Hosts.
 var bucket string
 var gcs *storage.Client
 
+// gcsTokens authorizes requests to GCS that the client can't make, like
+// starting the resumable upload sessions Tus uses, as the client would.
+var gcsTokens oauth2.TokenSource
+
 // setup performs one-time setup for the GCS backend.
 func Setup() error {
 	// set the bucket name from environment variable
 	bucket = os.Getenv("BUCKET_NAME")
+	if project := os.Getenv("BILLING_PROJECT"); project != "" {
+		BillingProject = project
+	}
+
+	// form upload policies are signed with a secret of our own
+	formPolicySecret = []byte(os.Getenv("POLICY_SECRET"))
+	if FormPolicies != nil && len(formPolicySecret) == 0 {
+		return errors.New("gcs: form policies need POLICY_SECRET")
+	}
 
 	// initialize the client
 	var err error
@@ -34,5 +53,24 @@ func Setup() error {
 	if err != nil {
 		return err
 	}
+	gcsTokens, err = google.DefaultTokenSource(context.Background(),
+		storage.ScopeReadWrite)
+	if err != nil {
+		return err
+	}
+	// and the clients for service accounts that mounts and hosts use
+	if err := impersonateServiceAccounts(context.Background()); err != nil {
+		return err
+	}
+
+	// read the bucket's website configuration, and keep it fresh. Buckets
+	// only served for some hosts are read when first used.
+	if bucket != "" {
+		loadWebsite(context.Background(), newSite(bucket, "", "", "").bucket, bucket)
+	}
+	go refreshWebsites()
+
+	// serve custom error pages
+	common.ErrorPageHandler = writeErrorPage
 	return nil
 }
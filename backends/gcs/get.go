@@ -52,56 +52,141 @@ type CacheGet func(string) ([]byte, bool)
 func ReadWithCache(ctx context.Context, response http.ResponseWriter,
 	request *http.Request, missPipeline filter.Pipeline, cacheGet CacheGet,
 	hitPipeline filter.Pipeline) {
-	// normalize path
-	objectName := common.NormalizePath(request.URL.Path)
-
-	// get the object handle and headers. Headers are always cached and obey
-	// Cache-Control header, so this will not call GCS unless there's a miss.
-	// In general, header hits and media hits should line up.
-	objectHandle := gcs.Bucket(bucket).Object(objectName)
-	// get static-serving metadata and set headers
-	err := setHeaders(ctx, objectHandle, response)
+	// find the object and set headers from its metadata
+	varyAsOf(response.Header())
+	var obj *servedObject
+	s, err := siteFor(request)
+	if err == nil && wantsVersions(request) {
+		listVersions(ctx, response, request, s, missPipeline)
+		return
+	}
+	if err == nil {
+		obj, err = objectFor(ctx, response, request, s)
+	}
 	if err != nil {
-		if err == storage.ErrObjectNotExist {
-			http.Error(response, "", http.StatusNotFound)
+		writeObjectError(ctx, response, request, s, err, missPipeline)
+		return
+	}
+	obj = precompressedFor(ctx, response, request, s, obj)
+	objectHandle, objectAttrs := obj.handle, obj.attrs
+	if objectAttrs.Generation > 0 {
+		// read the generation the headers and ranges are for, even if the
+		// attributes are cached and the object has changed since
+		objectHandle = objectHandle.Generation(objectAttrs.Generation)
+	}
+	if objectAttrs.ContentEncoding != "" {
+		// read the media as it is stored; GCS would decompress gzip
+		objectHandle = objectHandle.ReadCompressed(true)
+	}
+
+	// answer conditional requests without touching the media
+	if obj.status == http.StatusOK {
+		if status := checkPreconditions(request, objectAttrs); status != 0 {
+			writePrecondition(response, request, status)
 			return
-		} else {
-			log.Error().Msgf("get: %v", err)
 		}
 	}
 
+	// send big objects straight from GCS
+	if location, ok := signedURLFor(request, s, obj); ok {
+		clearObjectHeaders(response.Header())
+		response.Header().Set("Cache-Control", "no-store")
+		http.Redirect(response, request, location, http.StatusFound)
+		return
+	}
+
+	// change the stored encoding, if the client doesn't accept it
+	transcode, target, transcoding := transcodingFor(response, request, obj)
+
 	// try the media cache
-	var media io.Reader
+	var open rangeOpener
 	var pipeline filter.Pipeline
-	maybeMedia, hit := cacheGet(objectName)
+	size := objectAttrs.Size
+	cacheKey := s.cacheKey(obj.ref)
+	if transcoding {
+		cacheKey = transcodedCacheKey(cacheKey, target)
+	}
+	ctx = common.WithCacheKey(ctx, cacheKey)
+	maybeMedia, hit := cacheGet(cacheKey)
 	if hit {
 		log.Debug().Msgf("gcs ReadWithCache: HIT")
-		media = bytes.NewReader(maybeMedia)
 		// transformations may be cached; use cached content length
-		response.Header().Set("Content-Length", fmt.Sprint(len(maybeMedia)))
+		size = int64(len(maybeMedia))
+		response.Header().Set("Content-Length", fmt.Sprint(size))
+		open = func(offset, length int64) (io.ReadCloser, error) {
+			if length < 0 {
+				length = size - offset
+			}
+			return io.NopCloser(bytes.NewReader(maybeMedia[offset : offset+length])), nil
+		}
 		pipeline = hitPipeline
 	} else {
 		log.Debug().Msgf("gcs ReadWithCache: MISS")
-		// get object content and send it
 		// TODO(domz): need an aggressive reader
-		objectContent, err := objectHandle.NewReader(ctx)
-		if err != nil {
-			log.Error().Msgf("get: %v", err)
+		open = func(offset, length int64) (io.ReadCloser, error) {
+			return objectHandle.NewRangeReader(ctx, offset, length)
 		}
-		defer objectContent.Close()
-		media = objectContent
 		pipeline = missPipeline
+		if transcoding {
+			pipeline = append(filter.Pipeline{transcode}, missPipeline...)
+		}
+	}
+
+	// work out what part of the object to send
+	var ranges []httpRange
+	if obj.status == http.StatusOK && rangesSupported(objectAttrs) {
+		ranges, err = requestedRanges(request, objectAttrs, size)
+		if err == errNoOverlap {
+			clearObjectHeaders(response.Header())
+			response.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", size))
+			common.Error(response, request, "", http.StatusRequestedRangeNotSatisfiable)
+			return
+		}
+	}
+
+	// get object content
+	var media io.ReadCloser
+	status := obj.status
+	if len(ranges) > 0 {
+		media, err = openRanges(response.Header(), ranges, size, open)
+		status = http.StatusPartialContent
+	} else {
+		media, err = open(0, -1)
+	}
+	if err == storage.ErrObjectNotExist {
+		// the generation is gone; the cached attributes were stale
+		objectMetadataCache.Delete(s.cacheKey(obj.ref))
+		clearObjectHeaders(response.Header())
+		response.Header().Set("Retry-After", "1")
+		common.Error(response, request, "", http.StatusServiceUnavailable)
+		return
 	}
+	if err != nil {
+		log.Error().Msgf("get: %v", err)
+		clearObjectHeaders(response.Header())
+		common.Error(response, request, "", http.StatusInternalServerError)
+		return
+	}
+	defer media.Close()
 
 	// serve the media
+	deferred := withStatus(response, status)
 	if len(pipeline) > 0 {
 		// use a filter pipeline
-		_, err = filter.PipelineCopy(ctx, response, media, request, pipeline)
+		_, err = filter.PipelineCopy(ctx, deferred, media, request, pipeline)
 	} else {
 		// unfiltered, simple copy
-		_, err = io.Copy(response, media)
+		_, err = io.Copy(deferred, media)
 	}
 	if err != nil {
 		log.Error().Msgf("ReadWithCache: %v", err)
+		if !deferred.wroteHeader {
+			// nothing was sent yet, so the client can be told
+			clearObjectHeaders(response.Header())
+			common.Error(response, request, "", http.StatusInternalServerError)
+		}
+		return
 	}
+	// an empty body still gets its status
+	deferred.flush()
 }
@@ -19,10 +19,8 @@ import (
 	"net/http"
 	"strings"
 
-	"github.com/DomZippilli/gcs-proxy-cloud-function/common"
 	"github.com/DomZippilli/gcs-proxy-cloud-function/filter"
 
-	storage "cloud.google.com/go/storage"
 	"github.com/rs/zerolog/log"
 )
 
@@ -30,22 +28,33 @@ import (
 // object names.
 func ReadMetadata(ctx context.Context, response http.ResponseWriter,
 	request *http.Request, pipeline filter.Pipeline) {
-	// normalize path
-	objectName := common.NormalizePath(request.URL.Path)
-
-	// get the object handle and headers. Attributes are always cached and obey
-	// Cache-Control header, so this will not call GCS unless there's a miss.
-	// In general, header hits and media hits should line up.
-	objectHandle := gcs.Bucket(bucket).Object(objectName)
-	// get static-serving metadata and set headers
-	err := setHeaders(ctx, objectHandle, response)
+	// find the object and set headers from its metadata
+	varyAsOf(response.Header())
+	var obj *servedObject
+	s, err := siteFor(request)
+	if err == nil && wantsVersions(request) {
+		listVersions(ctx, response, request, s, pipeline)
+		return
+	}
+	if err == nil {
+		obj, err = objectFor(ctx, response, request, s)
+	}
 	if err != nil {
-		if err == storage.ErrObjectNotExist {
-			http.Error(response, "", http.StatusNotFound)
+		writeObjectError(ctx, response, request, s, err, pipeline)
+		return
+	}
+	obj = precompressedFor(ctx, response, request, s, obj)
+	transcodingFor(response, request, obj)
+
+	// answer conditional requests
+	if obj.status == http.StatusOK {
+		if status := checkPreconditions(request, obj.attrs); status != 0 {
+			writePrecondition(response, request, status)
 			return
-		} else {
-			log.Error().Msgf("get: %v", err)
 		}
+	} else {
+		// there's no body to hold back the status for
+		response.WriteHeader(obj.status)
 	}
 
 	// serve the metadata
@@ -33,13 +33,14 @@ import (
 var objectMetadataCache = cache.New(90*time.Second, 10*time.Minute)
 
 // setHeaders will transfer HTTP headers from GCS metadata to the response.
-func setHeaders(ctx context.Context, objectHandle *storage.ObjectHandle,
-	response http.ResponseWriter) (err error) {
+// The object's attributes are returned for further use.
+func setHeaders(ctx context.Context, s *site, ref objectRef,
+	response http.ResponseWriter) (objectAttrs *storage.ObjectAttrs, err error) {
 
 	// get object metadata. Use a cache to speed up TTFB.
-	objectAttrs, err := getAttrs(ctx, objectHandle)
+	objectAttrs, err = getAttrs(ctx, s, ref)
 	if err != nil {
-		return err
+		return
 	}
 
 	// set all headers
@@ -52,24 +53,49 @@ func setHeaders(ctx context.Context, objectHandle *storage.ObjectHandle,
 	if objectAttrs.ContentLanguage != "" {
 		response.Header().Set("Content-Language", objectAttrs.ContentLanguage)
 	}
-	if objectAttrs.ContentType != "" {
-		response.Header().Set("Content-Type", objectAttrs.ContentType)
+	contentType, authoritative := contentTypeFor(ctx, s, ref, objectAttrs)
+	if contentType != "" {
+		response.Header().Set("Content-Type", contentType)
+	}
+	if authoritative {
+		response.Header().Set("X-Content-Type-Options", "nosniff")
 	}
 	response.Header().Set("Content-Length", fmt.Sprint(objectAttrs.Size))
+	response.Header().Set("ETag", objectETag(objectAttrs))
+	response.Header().Set("Last-Modified",
+		lastModified(objectAttrs).Format(http.TimeFormat))
+	if rangesSupported(objectAttrs) {
+		response.Header().Set("Accept-Ranges", "bytes")
+	} else {
+		response.Header().Set("Accept-Ranges", "none")
+	}
 	return
 }
 
+// rangesSupported tells whether byte ranges of an object can be served. GCS
+// serves objects stored with a Content-Encoding whole, regardless of range,
+// so those are always sent in full.
+func rangesSupported(objectAttrs *storage.ObjectAttrs) bool {
+	return objectAttrs.ContentEncoding == ""
+}
+
 // getAttrs will get the metadata of an object, using a local cache to
-// store metadata and avoid repeated metadata GETs.
-func getAttrs(ctx context.Context, objectHandle *storage.ObjectHandle) (
+// store metadata and avoid repeated metadata GETs. Entries are kept in the
+// site's cache namespace. The object is resolved to a generation first, if
+// the site is viewed as of a past time.
+func getAttrs(ctx context.Context, s *site, ref objectRef) (
 	objectAttrs *storage.ObjectAttrs, err error) {
+	ref, err = s.resolve(ctx, ref)
+	if err != nil {
+		return
+	}
 	// get object metadata. Use a cache to speed up TTFB.
-	maybeAttrs, hit := objectMetadataCache.Get(objectHandle.ObjectName())
+	maybeAttrs, hit := objectMetadataCache.Get(s.cacheKey(ref))
 	if hit {
 		objectAttrs = maybeAttrs.(*storage.ObjectAttrs)
 	} else {
 		// TODO(domz): no need for full projection here
-		objectAttrs, err = objectHandle.Attrs(ctx)
+		objectAttrs, err = s.handle(ref).Attrs(ctx)
 		if err != nil {
 			return
 		}
@@ -85,7 +111,7 @@ func getAttrs(ctx context.Context, objectHandle *storage.ObjectHandle) (
 				expiry = time.Second * time.Duration(ccSecs)
 			}
 		}
-		objectMetadataCache.Set(objectHandle.ObjectName(), objectAttrs, expiry)
+		objectMetadataCache.Set(s.cacheKey(ref), objectAttrs, expiry)
 	}
 	return
 }
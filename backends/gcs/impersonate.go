@@ -0,0 +1,88 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package gcs
+
+import (
+	"context"
+	"fmt"
+
+	storage "cloud.google.com/go/storage"
+	"golang.org/x/oauth2"
+	"google.golang.org/api/impersonate"
+	"google.golang.org/api/option"
+)
+
+// iamScope lets a token call the IAM credentials API, to sign blobs.
+const iamScope = "https://www.googleapis.com/auth/iam"
+
+// serviceAccountClients are the clients for the service accounts that mounts
+// and hosts impersonate, by email. They are made in Setup.
+var serviceAccountClients = map[string]*storage.Client{}
+
+// serviceAccountTokens are the token sources the clients in
+// serviceAccountClients use, by email.
+var serviceAccountTokens = map[string]oauth2.TokenSource{}
+
+// impersonateServiceAccounts makes a client for each service account named in
+// Mounts and Hosts. The proxy's own service account needs the
+// iam.serviceAccounts.getAccessToken permission on each of them.
+func impersonateServiceAccounts(ctx context.Context) error {
+	var accounts []string
+	for _, m := range Mounts {
+		accounts = append(accounts, m.ServiceAccount)
+	}
+	for _, h := range Hosts {
+		accounts = append(accounts, h.ServiceAccount)
+	}
+	for _, account := range accounts {
+		if _, ok := serviceAccountClients[account]; ok || account == "" {
+			continue
+		}
+		tokenSource, err := impersonate.CredentialsTokenSource(ctx,
+			impersonate.CredentialsConfig{
+				TargetPrincipal: account,
+				// read and write objects, but not ACLs or IAM policies. The
+				// iam scope lets the account sign URLs, too.
+				Scopes: []string{storage.ScopeReadWrite, iamScope},
+			})
+		if err != nil {
+			return fmt.Errorf("gcs: impersonating %v: %w", account, err)
+		}
+		client, err := storage.NewClient(ctx, option.WithTokenSource(tokenSource))
+		if err != nil {
+			return fmt.Errorf("gcs: client for %v: %w", account, err)
+		}
+		serviceAccountClients[account] = client
+		serviceAccountTokens[account] = tokenSource
+	}
+	return nil
+}
+
+// clientFor gets the client for a service account, or the proxy's own client
+// if there is none.
+func clientFor(serviceAccount string) *storage.Client {
+	if client, ok := serviceAccountClients[serviceAccount]; ok {
+		return client
+	}
+	return gcs
+}
+
+// tokensFor gets the token source for a service account, or the proxy's own
+// if there is none.
+func tokensFor(serviceAccount string) oauth2.TokenSource {
+	if tokens, ok := serviceAccountTokens[serviceAccount]; ok {
+		return tokens
+	}
+	return gcsTokens
+}
@@ -0,0 +1,103 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package gcs
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"sync"
+
+	storage "cloud.google.com/go/storage"
+)
+
+// ingestWriter stands in for the response when filters are applied to an
+// upload. What the filters write goes to the object, and the headers they
+// leave become the object's attributes. An error status from a filter
+// abandons the write.
+type ingestWriter struct {
+	mu      sync.Mutex
+	header  http.Header
+	writer  *storage.Writer
+	cancel  context.CancelFunc
+	started bool
+	status  int
+}
+
+// newIngestWriter makes an ingestWriter writing to writer, with the
+// headers that set object attributes copied from the request. cancel
+// abandons the write.
+func newIngestWriter(writer *storage.Writer, requestHeader http.Header,
+	cancel context.CancelFunc) *ingestWriter {
+	header := http.Header{}
+	for name, values := range requestHeader {
+		switch {
+		case name == "Content-Type", name == "Cache-Control",
+			name == "Content-Disposition", name == "Content-Encoding",
+			name == "Content-Language", strings.HasPrefix(name, metadataHeaderPrefix):
+			header[name] = append([]string(nil), values...)
+		}
+	}
+	return &ingestWriter{header: header, writer: writer, cancel: cancel}
+}
+
+// Header returns the headers that will become the object's attributes.
+func (w *ingestWriter) Header() http.Header {
+	return w.header
+}
+
+// WriteHeader abandons the write if statusCode is an error. Other status
+// codes mean nothing here.
+func (w *ingestWriter) WriteHeader(statusCode int) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if statusCode >= 400 && w.status == 0 {
+		w.status = statusCode
+		w.cancel()
+	}
+}
+
+// Write writes to the object, unless the write was abandoned, in which case
+// the bytes are dropped.
+func (w *ingestWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.status != 0 {
+		return len(p), nil
+	}
+	w.startLocked()
+	return w.writer.Write(p)
+}
+
+// start sets the object's attributes from the headers, if it hasn't been
+// done. That must happen before the writer is written to or closed.
+func (w *ingestWriter) start() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.startLocked()
+}
+
+func (w *ingestWriter) startLocked() {
+	if !w.started {
+		setWriterAttrs(&w.writer.ObjectAttrs, w.header)
+		w.started = true
+	}
+}
+
+// refused is the error status a filter abandoned the write with, or 0.
+func (w *ingestWriter) refused() int {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.status
+}
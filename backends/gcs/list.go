@@ -0,0 +1,205 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package gcs
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"html/template"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/DomZippilli/gcs-proxy-cloud-function/common"
+	"github.com/DomZippilli/gcs-proxy-cloud-function/filter"
+
+	storage "cloud.google.com/go/storage"
+	"github.com/rs/zerolog/log"
+	"google.golang.org/api/iterator"
+)
+
+// Autoindex enables directory listings. When a path ending in "/" has no index
+// object, the objects and sub-prefixes under it are listed instead of a 404.
+var Autoindex = false
+
+// AutoindexPageSize is the most entries shown on one page of a listing.
+var AutoindexPageSize = 100
+
+// listing is a page of a directory listing, as rendered to HTML or JSON.
+type listing struct {
+	Prefix        string         `json:"prefix"`
+	Directories   []string       `json:"directories"`
+	Objects       []listingEntry `json:"objects"`
+	NextPageToken string         `json:"nextPageToken,omitempty"`
+}
+
+// listingEntry describes one object in a listing.
+type listingEntry struct {
+	Name        string    `json:"name"`
+	Size        int64     `json:"size"`
+	ContentType string    `json:"contentType,omitempty"`
+	Updated     time.Time `json:"updated"`
+}
+
+// listingTemplate renders a listing to HTML.
+var listingTemplate = template.Must(template.New("listing").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Index of /{{.Prefix}}</title>
+</head>
+<body>
+<h1>Index of /{{.Prefix}}</h1>
+<table>
+<tr><th>Name</th><th>Size</th><th>Type</th><th>Updated</th></tr>
+{{- if .Prefix}}
+<tr><td><a href="../">../</a></td><td></td><td></td><td></td></tr>
+{{- end}}
+{{- range .Directories}}
+<tr><td><a href="./{{.}}">{{.}}</a></td><td>-</td><td></td><td></td></tr>
+{{- end}}
+{{- range .Objects}}
+<tr><td><a href="./{{.Name}}">{{.Name}}</a></td><td>{{.Size}}</td><td>{{.ContentType}}</td><td>{{.Updated.UTC.Format "2006-01-02 15:04:05"}}</td></tr>
+{{- end}}
+</table>
+{{- if .NextPageToken}}
+<p><a href="?page={{.NextPageToken}}">Next page</a></p>
+{{- end}}
+</body>
+</html>
+`))
+
+// isDirectory tells whether a URL path names a directory, rather than an
+// object.
+func isDirectory(path string) bool {
+	return path == "" || strings.HasSuffix(path, "/")
+}
+
+// listPrefix responds with a page of the listing of objects and sub-prefixes
+// under prefix, within a site. The page to list is given by the "page" query
+// parameter. JSON is sent if the client accepts it; otherwise, HTML.
+//
+// A prefix with nothing under it is a 404, unless there is a placeholder
+// object named like the directory. Uploads in progress, and the rules files
+// when RulesFromBucket is on, aren't listed, as they aren't served.
+//
+// If the site is viewed as of a past time, the objects live at that time are
+// listed. Sub-prefixes are listed if they have ever held an object.
+func listPrefix(ctx context.Context, response http.ResponseWriter,
+	request *http.Request, s *site, prefix string, pipeline filter.Pipeline) {
+	fullPrefix := s.prefix + prefix
+	query := &storage.Query{Prefix: fullPrefix, Delimiter: "/",
+		Versions: !s.asOf.IsZero()}
+	query.SetAttrSelection([]string{"Name", "Size", "ContentType", "Updated",
+		"Created", "Deleted"})
+	it := s.bucket.Objects(ctx, query)
+
+	var page []*storage.ObjectAttrs
+	pageToken := request.URL.Query().Get("page")
+	nextPageToken, err := iterator.NewPager(it, AutoindexPageSize, pageToken).
+		NextPage(&page)
+	if err != nil {
+		writeGoogleAPIError(response, request, err)
+		return
+	}
+
+	// sort out directories and objects, relative to the prefix
+	l := listing{
+		Prefix:        prefix,
+		Directories:   []string{},
+		Objects:       []listingEntry{},
+		NextPageToken: nextPageToken,
+	}
+	// an object named like the directory, as consoles make, means it exists
+	placeholder := false
+	for _, attrs := range page {
+		if attrs.Prefix != "" {
+			if attrs.Prefix == s.prefix+tusStatePrefix {
+				continue
+			}
+			l.Directories = append(l.Directories,
+				strings.TrimPrefix(attrs.Prefix, fullPrefix))
+		} else if !s.asOf.IsZero() && !liveAt(attrs, s.asOf) {
+			continue
+		} else if attrs.Name == fullPrefix {
+			placeholder = true
+		} else if !RulesFromBucket ||
+			!isRulesFile(strings.TrimPrefix(attrs.Name, s.prefix)) {
+			// rules files aren't served, so they aren't listed
+			l.Objects = append(l.Objects, listingEntry{
+				Name:        strings.TrimPrefix(attrs.Name, fullPrefix),
+				Size:        attrs.Size,
+				ContentType: attrs.ContentType,
+				Updated:     attrs.Updated,
+			})
+		}
+	}
+
+	// there's no such directory, only a URL that looks like one
+	if pageToken == "" && !placeholder && len(l.Directories) == 0 &&
+		len(l.Objects) == 0 {
+		common.Error(response, request, "", http.StatusNotFound)
+		return
+	}
+	renderListing(ctx, response, request, l, listingTemplate, pipeline)
+}
+
+// renderListing sends a listing as JSON, or as HTML using tmpl, depending on
+// what the client accepts. Listings are generated on every request, so they
+// are not cached.
+func renderListing(ctx context.Context, response http.ResponseWriter,
+	request *http.Request, l interface{}, tmpl *template.Template,
+	pipeline filter.Pipeline) {
+	media := new(bytes.Buffer)
+	var err error
+	if acceptsJSON(request) {
+		response.Header().Set("Content-Type", "application/json")
+		err = json.NewEncoder(media).Encode(l)
+	} else {
+		response.Header().Set("Content-Type", "text/html; charset=utf-8")
+		err = tmpl.Execute(media, l)
+	}
+	if err != nil {
+		log.Error().Msgf("list: %v", err)
+		common.Error(response, request, "", http.StatusInternalServerError)
+		return
+	}
+	response.Header().Set("Cache-Control", "no-store")
+	common.AddVary(response.Header(), "Accept")
+
+	// serve the listing
+	if len(pipeline) > 0 {
+		// use a filter pipeline
+		_, err = filter.PipelineCopy(ctx, response, media, request, pipeline)
+	} else {
+		// unfiltered, simple copy
+		_, err = io.Copy(response, media)
+	}
+	if err != nil {
+		log.Error().Msgf("list: %v", err)
+	}
+}
+
+// acceptsJSON tells whether the client asked for JSON in its Accept header.
+func acceptsJSON(request *http.Request) bool {
+	for _, accept := range strings.Split(request.Header.Get("Accept"), ",") {
+		mediaType, _, _ := strings.Cut(accept, ";")
+		if strings.TrimSpace(mediaType) == "application/json" {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,221 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package gcs
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/DomZippilli/gcs-proxy-cloud-function/common"
+	"github.com/DomZippilli/gcs-proxy-cloud-function/filter"
+	"github.com/DomZippilli/gcs-proxy-cloud-function/rules"
+
+	storage "cloud.google.com/go/storage"
+)
+
+// servedObject is the object found to serve a request.
+type servedObject struct {
+	ref    objectRef
+	handle *storage.ObjectHandle
+	attrs  *storage.ObjectAttrs
+	// status is the status code to serve the object with. This is 200, unless
+	// the object is standing in for a missing one, like a 404 page.
+	status int
+	// encoding is the content coding of a precompressed copy being served in
+	// place of the object, if one is.
+	encoding string
+}
+
+// objectFor finds the object that serves a request, and sets response headers
+// from its metadata.
+//
+// Usually this is just the object named by the URL path, but the object may
+// turn out to be a redirect, or a missing object may be stood in for by an SPA
+// fallback. As with GCS website hosting, a missing object that is a directory
+// with a main page redirects to the directory. Directories are left alone when
+// Autoindex is on, so they can be listed.
+//
+// If RulesFromBucket is on, _redirects rules are applied to the URL path
+// first, and _headers rules are applied to the response last.
+//
+// If ServeGenerations is on, a generation given in the query is served
+// instead of the live object. There is no stand-in for a missing generation.
+func objectFor(ctx context.Context, response http.ResponseWriter,
+	request *http.Request, s *site) (obj *servedObject, err error) {
+	website := websiteFor(ctx, s.ownBucket, s.bucketName)
+	urlPath := s.path(request.URL.Path)
+	status := http.StatusOK
+	generation, err := generationFor(request)
+	if err != nil {
+		return nil, err
+	}
+
+	// what the caller's own credentials got mustn't be kept for others. This
+	// comes last, over the object's and the rules' headers.
+	if s.userClient != nil {
+		defer func() {
+			response.Header().Set("Cache-Control", passThroughCacheControl)
+			common.AddVary(response.Header(), "Authorization")
+		}()
+	}
+
+	// a mount's own path is its root directory
+	if urlPath == "" {
+		return nil, &redirect{request.URL.Path + "/", http.StatusMovedPermanently}
+	}
+
+	// uploads in progress aren't served
+	if isTusState(urlPath) {
+		return nil, storage.ErrObjectNotExist
+	}
+
+	// apply the rules files
+	if RulesFromBucket {
+		if isRulesFile(urlPath) {
+			return nil, storage.ErrObjectNotExist
+		}
+		redirects, headers := rulesFor(ctx, s)
+		target, ok := rules.MatchRedirects(redirects, urlPath, request.URL.Query())
+		if ok && !target.Force {
+			// rules don't shadow objects that exist, unless forced
+			objectName := s.objectName(urlPath, mainPageSuffix(website))
+			_, err := getAttrs(ctx, s, objectRef{name: objectName})
+			ok = err == storage.ErrObjectNotExist
+		}
+		if ok && !target.IsRewrite() {
+			location := target.Location
+			if strings.HasPrefix(location, "/") {
+				location = s.url(location)
+			}
+			return nil, &redirect{location, target.Status}
+		}
+		if ok {
+			urlPath, status = target.Location, target.Status
+		}
+		defer func() {
+			if err == nil {
+				setRuleHeaders(response, headers, s.path(request.URL.Path))
+			}
+		}()
+	}
+
+	// normalize path
+	objectName := s.objectName(urlPath, mainPageSuffix(website))
+
+	// get the object headers. Attributes are always cached and obey
+	// Cache-Control header, so this will not call GCS unless there's a miss.
+	// In general, header hits and media hits should line up.
+	var objectAttrs *storage.ObjectAttrs
+	ref, err := s.resolve(ctx, objectRef{objectName, generation})
+	if err == nil {
+		objectAttrs, err = setHeaders(ctx, s, ref, response)
+	}
+	if err == nil {
+		if rd := metadataRedirect(objectAttrs); rd != nil {
+			// site-relative locations stay in the mount and view, as rules do
+			if strings.HasPrefix(rd.location, "/") {
+				rd.location = s.url(rd.location)
+			}
+			return nil, rd
+		}
+		if generation > 0 {
+			// this exact content will be served for as long as it exists
+			response.Header().Set("Cache-Control", immutableCacheControl)
+		}
+		if !s.asOf.IsZero() {
+			// the view is only for those authorized to see it
+			response.Header().Set("Cache-Control", asOfCacheControl)
+		}
+		return &servedObject{ref: ref, handle: s.handle(ref), attrs: objectAttrs,
+			status: status}, nil
+	}
+	if err != storage.ErrObjectNotExist || generation > 0 ||
+		(Autoindex && isDirectory(urlPath)) {
+		return nil, err
+	}
+
+	// missing; maybe it's a directory, missing its trailing slash
+	if !isDirectory(urlPath) {
+		mainPage := objectRef{name: objectName + "/" + mainPageSuffix(website)}
+		if _, err := getAttrs(ctx, s, mainPage); err == nil {
+			location := s.url(urlPath) + "/"
+			if request.URL.RawQuery != "" {
+				location += "?" + request.URL.RawQuery
+			}
+			return nil, &redirect{location, http.StatusMovedPermanently}
+		}
+	}
+
+	// maybe there's something to serve instead
+	if fallback, ok := fallbackFor(s.mount + urlPath); ok {
+		ref, err = s.resolve(ctx, objectRef{name: s.prefix + fallback})
+		if err == nil {
+			objectAttrs, err = setHeaders(ctx, s, ref, response)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if !s.asOf.IsZero() {
+			response.Header().Set("Cache-Control", asOfCacheControl)
+		}
+		return &servedObject{ref: ref, handle: s.handle(ref), attrs: objectAttrs,
+			status: status}, nil
+	}
+	return nil, err
+}
+
+// writeObjectError answers a request whose object couldn't be served, as
+// found by siteFor and objectFor. Directories without an index are listed
+// here, if Autoindex is on, using the given pipeline.
+func writeObjectError(ctx context.Context, response http.ResponseWriter,
+	request *http.Request, s *site, err error, pipeline filter.Pipeline) {
+	var rd *redirect
+	switch {
+	case errors.As(err, &rd):
+		clearObjectHeaders(response.Header())
+		http.Redirect(response, request, rd.location, rd.status)
+	case err == errNoSite:
+		http.Error(response, "", http.StatusNotFound)
+	case err == errBadGeneration || err == errBadAsOf ||
+		err == errBadBillingProject:
+		common.Error(response, request, "", http.StatusBadRequest)
+	case err == errAsOfForbidden:
+		common.Error(response, request, "", http.StatusForbidden)
+	case err == errNoCredentials:
+		response.Header().Set("WWW-Authenticate", "Bearer")
+		common.Error(response, request, "", http.StatusUnauthorized)
+	case err == storage.ErrObjectNotExist:
+		if Autoindex && isDirectory(s.path(request.URL.Path)) {
+			listPrefix(ctx, response, request, s,
+				strings.TrimLeft(s.path(request.URL.Path), "/"), pipeline)
+			return
+		}
+		common.Error(response, request, "", http.StatusNotFound)
+	default:
+		writeGoogleAPIError(response, request, err)
+	}
+}
+
+// clearObjectHeaders removes headers set from an object's metadata that don't
+// apply when something other than the object is sent, like an error page.
+// Cache-Control is kept.
+func clearObjectHeaders(header http.Header) {
+	for _, h := range []string{"Accept-Ranges", "Content-Encoding",
+		"Content-Language", "Content-Length", "Content-Range", "Content-Type",
+		"ETag", "Last-Modified", "X-Content-Type-Options"} {
+		header.Del(h)
+	}
+}
@@ -0,0 +1,93 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package gcs
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	storage "cloud.google.com/go/storage"
+	cache "github.com/patrickmn/go-cache"
+	"golang.org/x/oauth2"
+	"google.golang.org/api/option"
+)
+
+// PassThroughCredentials makes requests to GCS with the caller's own OAuth
+// access token, from their "Authorization: Bearer" header, rather than the
+// proxy's identity. GCS then enforces the caller's permissions: a 401 or 403
+// from GCS is passed on to the caller, and requests without a token get a
+// 401.
+//
+// The attribute and media caches are partitioned by token, so nothing one
+// caller could read is served to another. For the same reason, objects are
+// sent with "Cache-Control: private, no-cache" and "Vary: Authorization",
+// whatever their own Cache-Control says, so shared caches don't keep them.
+// Signed URL redirects (see SignedURLRules) aren't used, as they would be
+// signed by the proxy.
+//
+// Bucket website configuration is still read with the proxy's identity.
+var PassThroughCredentials = false
+
+// passThroughCacheControl is sent with objects read with a caller's own
+// credentials. Others may not be allowed to see them.
+const passThroughCacheControl = "private, no-cache"
+
+// userClientTTL is how long a client for a token is kept after its last use.
+// Access tokens last an hour, at most.
+const userClientTTL = 10 * time.Minute
+
+// errNoCredentials is returned for a request without a bearer token, when
+// PassThroughCredentials is on.
+var errNoCredentials = errors.New("no bearer token")
+
+// userClients holds a storage client for each token recently used, by the
+// token's hash. Clients aren't closed when they expire, since a long download
+// or upload may still be using one. Once nothing is, their idle connections
+// time out, and they are garbage collected.
+var userClients = cache.New(userClientTTL, time.Minute)
+
+// bearerToken gets the access token from a request's Authorization header.
+func bearerToken(request *http.Request) (string, bool) {
+	scheme, token, ok := strings.Cut(request.Header.Get("Authorization"), " ")
+	token = strings.TrimSpace(token)
+	if !ok || !strings.EqualFold(scheme, "Bearer") || token == "" {
+		return "", false
+	}
+	return token, true
+}
+
+// userClientFor gets a storage client that uses an access token, and the
+// token's hash, which stands in for the token wherever it would be kept.
+func userClientFor(token string) (*storage.Client, string, error) {
+	sum := sha256.Sum256([]byte(token))
+	hash := hex.EncodeToString(sum[:])
+	if client, hit := userClients.Get(hash); hit {
+		// keep it while it's in use
+		userClients.SetDefault(hash, client)
+		return client.(*storage.Client), hash, nil
+	}
+	client, err := storage.NewClient(context.Background(),
+		option.WithTokenSource(oauth2.StaticTokenSource(
+			&oauth2.Token{AccessToken: token})))
+	if err != nil {
+		return nil, "", err
+	}
+	userClients.SetDefault(hash, client)
+	return client, hash, nil
+}
@@ -0,0 +1,138 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package gcs
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/DomZippilli/gcs-proxy-cloud-function/common"
+
+	storage "cloud.google.com/go/storage"
+	cache "github.com/patrickmn/go-cache"
+	"github.com/rs/zerolog/log"
+)
+
+// ServePrecompressed enables serving copies of objects compressed ahead of
+// time, like app.js.br for app.js, to clients that accept their encoding.
+// The copy is sent with the Content-Encoding of the copy and the Content-Type
+// of the object. If there is no acceptable copy, the object is sent as usual.
+//
+// Filters see the compressed content, so pipelines for sites with
+// precompressed copies shouldn't change the content.
+var ServePrecompressed = false
+
+// Precompressed is a kind of precompressed copy: a content coding, and the
+// suffix added to an object's name to name its copy in that coding.
+type Precompressed struct {
+	Encoding string
+	Suffix   string
+}
+
+// PrecompressedCopies are the copies looked for, in order of preference when
+// the client likes them equally.
+var PrecompressedCopies = []Precompressed{
+	{Encoding: "br", Suffix: ".br"},
+	{Encoding: "zstd", Suffix: ".zst"},
+	{Encoding: "gzip", Suffix: ".gz"},
+}
+
+// missingCopies remembers precompressed copies that don't exist, so they
+// aren't looked for on every request. It expires as the attribute cache does.
+var missingCopies = cache.New(90*time.Second, 10*time.Minute)
+
+// precompressedFor finds the best precompressed copy of an object that a
+// request accepts, and sets the response headers to serve it. The object
+// itself is returned if there is none. Objects already stored with a
+// Content-Encoding, and those pinned to a generation, are left alone.
+func precompressedFor(ctx context.Context, response http.ResponseWriter,
+	request *http.Request, s *site, obj *servedObject) *servedObject {
+	if !ServePrecompressed || obj.attrs.ContentEncoding != "" ||
+		(obj.ref.generation > 0 && s.asOf.IsZero()) {
+		return obj
+	}
+	// whether there's a copy or not, it depends on the encodings accepted
+	common.AddVary(response.Header(), "Accept-Encoding")
+
+	offered := make([]string, 0, len(PrecompressedCopies))
+	suffixes := map[string]string{}
+	for _, p := range PrecompressedCopies {
+		offered = append(offered, p.Encoding)
+		suffixes[p.Encoding] = p.Suffix
+	}
+	for len(offered) > 0 {
+		encoding := common.NegotiateEncoding(request, offered)
+		if encoding == "" {
+			break
+		}
+		copyAttrs, ref, err := precompressedCopy(ctx, s,
+			objectRef{name: obj.ref.name + suffixes[encoding]})
+		if err == nil {
+			header := response.Header()
+			header.Set("Content-Encoding", encoding)
+			header.Set("Content-Length", fmt.Sprint(copyAttrs.Size))
+			header.Set("ETag", objectETag(copyAttrs))
+			header.Set("Last-Modified",
+				lastModified(copyAttrs).Format(http.TimeFormat))
+			if rangesSupported(copyAttrs) {
+				header.Set("Accept-Ranges", "bytes")
+			} else {
+				header.Set("Accept-Ranges", "none")
+			}
+			return &servedObject{
+				ref: ref,
+				// send the copy as it is stored, even if GCS could decompress it
+				handle:   s.handle(ref).ReadCompressed(true),
+				attrs:    copyAttrs,
+				status:   obj.status,
+				encoding: encoding,
+			}
+		}
+		if err != storage.ErrObjectNotExist {
+			log.Warn().Msgf("precompressed %v: %v", ref.name, err)
+		}
+		// try the next best
+		for i := range offered {
+			if offered[i] == encoding {
+				offered = append(offered[:i], offered[i+1:]...)
+				break
+			}
+		}
+	}
+	return obj
+}
+
+// precompressedCopy gets the attributes of a precompressed copy, and the copy
+// resolved to a generation, if the site is viewed as of a past time.
+func precompressedCopy(ctx context.Context, s *site, ref objectRef) (
+	*storage.ObjectAttrs, objectRef, error) {
+	key := s.cacheKey(ref)
+	if _, missing := missingCopies.Get(key); missing {
+		return nil, ref, storage.ErrObjectNotExist
+	}
+	ref, err := s.resolve(ctx, ref)
+	if err == nil {
+		var copyAttrs *storage.ObjectAttrs
+		copyAttrs, err = getAttrs(ctx, s, ref)
+		if err == nil {
+			return copyAttrs, ref, nil
+		}
+	}
+	if err == storage.ErrObjectNotExist {
+		missingCopies.Set(key, true, cache.DefaultExpiration)
+	}
+	return nil, ref, err
+}
@@ -0,0 +1,240 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package gcs
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"strconv"
+	"strings"
+
+	storage "cloud.google.com/go/storage"
+)
+
+// maxRanges is the most ranges we will serve in one multipart response.
+// Requests for more are served in full, like an absent Range header.
+const maxRanges = 32
+
+// errNoOverlap is returned by parseRange when none of the requested ranges
+// overlap the media. This should be answered with a 416.
+var errNoOverlap = errors.New("invalid range: failed to overlap")
+
+// httpRange is a byte range of media, as requested with a Range header.
+type httpRange struct {
+	start, length int64
+}
+
+// contentRange formats the range for a Content-Range header.
+func (r httpRange) contentRange(size int64) string {
+	return fmt.Sprintf("bytes %d-%d/%d", r.start, r.start+r.length-1, size)
+}
+
+// rangeOpener opens a reader over length bytes of media, starting at offset.
+// A negative length reads to the end of the media.
+type rangeOpener func(offset, length int64) (io.ReadCloser, error)
+
+// requestedRanges returns the ranges the request asks for out of size bytes of
+// media. No ranges means the whole media should be sent with a 200.
+//
+// Per RFC 7233, a malformed Range header is ignored rather than rejected, as
+// is a Range header whose If-Range precondition doesn't hold.
+func requestedRanges(request *http.Request, objectAttrs *storage.ObjectAttrs,
+	size int64) ([]httpRange, error) {
+	rangeHeader := request.Header.Get("Range")
+	if rangeHeader == "" || !ifRange(request, objectAttrs) {
+		return nil, nil
+	}
+	ranges, err := parseRange(rangeHeader, size)
+	if err == errNoOverlap {
+		return nil, err
+	}
+	if err != nil || len(ranges) > maxRanges || sumRanges(ranges) > size {
+		// not worth serving; send the whole thing
+		return nil, nil
+	}
+	return ranges, nil
+}
+
+// ifRange evaluates the If-Range precondition, which may hold either an
+// entity tag (compared strongly) or an HTTP-date.
+func ifRange(request *http.Request, objectAttrs *storage.ObjectAttrs) bool {
+	ir := textproto.TrimString(request.Header.Get("If-Range"))
+	if ir == "" {
+		return true
+	}
+	if strings.HasPrefix(ir, `"`) || strings.HasPrefix(ir, "W/") {
+		return etagListMatch(ir, objectETag(objectAttrs), false)
+	}
+	t, err := http.ParseTime(ir)
+	if err != nil {
+		return false
+	}
+	return lastModified(objectAttrs).Equal(t)
+}
+
+// parseRange parses a Range header against media of the given size.
+func parseRange(s string, size int64) ([]httpRange, error) {
+	const b = "bytes="
+	if !strings.HasPrefix(s, b) {
+		return nil, errors.New("invalid range")
+	}
+	var ranges []httpRange
+	noOverlap := false
+	for _, ra := range strings.Split(s[len(b):], ",") {
+		ra = textproto.TrimString(ra)
+		if ra == "" {
+			continue
+		}
+		start, end, ok := strings.Cut(ra, "-")
+		if !ok {
+			return nil, errors.New("invalid range")
+		}
+		start, end = textproto.TrimString(start), textproto.TrimString(end)
+		var r httpRange
+		if start == "" {
+			// suffix range, e.g., "-500" is the last 500 bytes
+			i, err := strconv.ParseInt(end, 10, 64)
+			if err != nil || i < 0 {
+				return nil, errors.New("invalid range")
+			}
+			if i == 0 {
+				noOverlap = true
+				continue
+			}
+			if i > size {
+				i = size
+			}
+			r.start = size - i
+			r.length = size - r.start
+		} else {
+			i, err := strconv.ParseInt(start, 10, 64)
+			if err != nil || i < 0 {
+				return nil, errors.New("invalid range")
+			}
+			if i >= size {
+				// starts past the end of the media
+				noOverlap = true
+				continue
+			}
+			r.start = i
+			if end == "" {
+				r.length = size - r.start
+			} else {
+				i, err := strconv.ParseInt(end, 10, 64)
+				if err != nil || r.start > i {
+					return nil, errors.New("invalid range")
+				}
+				if i >= size {
+					i = size - 1
+				}
+				r.length = i - r.start + 1
+			}
+		}
+		ranges = append(ranges, r)
+	}
+	if noOverlap && len(ranges) == 0 {
+		return nil, errNoOverlap
+	}
+	return ranges, nil
+}
+
+// sumRanges totals the lengths of the ranges.
+func sumRanges(ranges []httpRange) (sum int64) {
+	for _, r := range ranges {
+		sum += r.length
+	}
+	return
+}
+
+// openRanges returns a reader over the given ranges of size bytes of media,
+// setting the Content-Range, Content-Type and Content-Length headers to match.
+//
+// A single range is read directly. Multiple ranges are streamed as a
+// multipart/byteranges body, opening each range only as it is reached.
+func openRanges(header http.Header, ranges []httpRange, size int64,
+	open rangeOpener) (io.ReadCloser, error) {
+	if len(ranges) == 1 {
+		ra := ranges[0]
+		media, err := open(ra.start, ra.length)
+		if err != nil {
+			return nil, err
+		}
+		header.Set("Content-Range", ra.contentRange(size))
+		header.Set("Content-Length", fmt.Sprint(ra.length))
+		return media, nil
+	}
+
+	pr, pw := io.Pipe()
+	mw := multipart.NewWriter(pw)
+
+	// size the multipart body ahead of time, so Content-Length is accurate
+	contentType := header.Get("Content-Type")
+	var length countingWriter
+	dryRun := multipart.NewWriter(&length)
+	dryRun.SetBoundary(mw.Boundary())
+	for _, ra := range ranges {
+		dryRun.CreatePart(rangePartHeader(ra, contentType, size))
+		length += countingWriter(ra.length)
+	}
+	dryRun.Close()
+
+	go func() {
+		for _, ra := range ranges {
+			part, err := mw.CreatePart(rangePartHeader(ra, contentType, size))
+			if err != nil {
+				pw.CloseWithError(err)
+				return
+			}
+			media, err := open(ra.start, ra.length)
+			if err != nil {
+				pw.CloseWithError(err)
+				return
+			}
+			_, err = io.Copy(part, media)
+			media.Close()
+			if err != nil {
+				pw.CloseWithError(err)
+				return
+			}
+		}
+		mw.Close()
+		pw.Close()
+	}()
+	header.Set("Content-Type", "multipart/byteranges; boundary="+mw.Boundary())
+	header.Set("Content-Length", fmt.Sprint(int64(length)))
+	return pr, nil
+}
+
+// rangePartHeader makes the header for one part of a multipart/byteranges body.
+func rangePartHeader(ra httpRange, contentType string, size int64) textproto.MIMEHeader {
+	partHeader := textproto.MIMEHeader{
+		"Content-Range": {ra.contentRange(size)},
+	}
+	if contentType != "" {
+		partHeader.Set("Content-Type", contentType)
+	}
+	return partHeader
+}
+
+// countingWriter counts how many bytes have been written to it.
+type countingWriter int64
+
+func (w *countingWriter) Write(p []byte) (n int, err error) {
+	*w += countingWriter(len(p))
+	return len(p), nil
+}
@@ -0,0 +1,124 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package gcs
+
+import (
+	"errors"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	storage "cloud.google.com/go/storage"
+)
+
+func TestParseRange(t *testing.T) {
+	const size = 1000
+	// any error other than errNoOverlap will do
+	errInvalid := errors.New("invalid range")
+	tests := []struct {
+		header string
+		want   []httpRange
+		err    error
+	}{
+		{"bytes=0-499", []httpRange{{0, 500}}, nil},
+		{"bytes=500-", []httpRange{{500, 500}}, nil},
+		{"bytes=999-999", []httpRange{{999, 1}}, nil},
+		{"bytes= 0-9 , 20-29", []httpRange{{0, 10}, {20, 10}}, nil},
+		// an end past the end of the media is cut short
+		{"bytes=900-1999", []httpRange{{900, 100}}, nil},
+		// suffix ranges are the last bytes
+		{"bytes=-500", []httpRange{{500, 500}}, nil},
+		{"bytes=-2000", []httpRange{{0, 1000}}, nil},
+		{"bytes=-0", nil, errNoOverlap},
+		// starts past the end don't overlap, but others may
+		{"bytes=1000-", nil, errNoOverlap},
+		{"bytes=5000-6000", nil, errNoOverlap},
+		{"bytes=1000-,0-9", []httpRange{{0, 10}}, nil},
+		{"bytes=,", nil, nil},
+		{"items=0-9", nil, errInvalid},
+		{"bytes=9-0", nil, errInvalid},
+		{"bytes=0", nil, errInvalid},
+		{"bytes=a-9", nil, errInvalid},
+		{"bytes=0-b", nil, errInvalid},
+		{"bytes=--5", nil, errInvalid},
+	}
+	for _, tc := range tests {
+		got, err := parseRange(tc.header, size)
+		switch {
+		case tc.err == nil && err != nil, tc.err != nil && err == nil,
+			tc.err == errNoOverlap && err != errNoOverlap:
+			t.Errorf("parseRange(%q) error = %v; want %v", tc.header, err, tc.err)
+		case !reflect.DeepEqual(got, tc.want):
+			t.Errorf("parseRange(%q) = %v; want %v", tc.header, got, tc.want)
+		}
+	}
+}
+
+func TestRequestedRanges(t *testing.T) {
+	const size = 1000
+	updated := time.Date(2021, 5, 1, 12, 0, 0, 0, time.UTC)
+	objectAttrs := &storage.ObjectAttrs{
+		MD5:     []byte{0xab, 0xcd},
+		Updated: updated.Add(500 * time.Millisecond),
+		Size:    size,
+	}
+	tooMany := "bytes=" + strings.Repeat("0-0,", maxRanges) + "0-0"
+	tests := []struct {
+		name    string
+		header  http.Header
+		want    []httpRange
+		noMatch bool
+	}{
+		{"no range", http.Header{}, nil, false},
+		{"one range", http.Header{"Range": {"bytes=0-9"}},
+			[]httpRange{{0, 10}}, false},
+		{"some ranges", http.Header{"Range": {"bytes=0-9,-10"}},
+			[]httpRange{{0, 10}, {990, 10}}, false},
+		{"malformed", http.Header{"Range": {"bytes=x-y"}}, nil, false},
+		{"past the end", http.Header{"Range": {"bytes=1000-"}}, nil, true},
+		{"too many", http.Header{"Range": {tooMany}}, nil, false},
+		{"more than the media", http.Header{"Range": {"bytes=0-599,400-999"}},
+			nil, false},
+		{"if-range etag", http.Header{"Range": {"bytes=0-9"},
+			"If-Range": {`"abcd"`}}, []httpRange{{0, 10}}, false},
+		{"if-range other etag", http.Header{"Range": {"bytes=0-9"},
+			"If-Range": {`"1234"`}}, nil, false},
+		{"if-range weak etag", http.Header{"Range": {"bytes=0-9"},
+			"If-Range": {`W/"abcd"`}}, nil, false},
+		{"if-range date", http.Header{"Range": {"bytes=0-9"},
+			"If-Range": {updated.Format(http.TimeFormat)}},
+			[]httpRange{{0, 10}}, false},
+		{"if-range other date", http.Header{"Range": {"bytes=0-9"},
+			"If-Range": {updated.Add(-time.Hour).Format(http.TimeFormat)}},
+			nil, false},
+		{"if-range garbage", http.Header{"Range": {"bytes=0-9"},
+			"If-Range": {"yesterday"}}, nil, false},
+		{"if-range past the end", http.Header{"Range": {"bytes=1000-"},
+			"If-Range": {`"1234"`}}, nil, false},
+	}
+	for _, tc := range tests {
+		request, _ := http.NewRequest(http.MethodGet, "/object", nil)
+		request.Header = tc.header
+		got, err := requestedRanges(request, objectAttrs, size)
+		if (err == errNoOverlap) != tc.noMatch || (err != nil && !tc.noMatch) {
+			t.Errorf("%s: error = %v; want no overlap %v", tc.name, err,
+				tc.noMatch)
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s: requestedRanges = %v; want %v", tc.name, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,83 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package gcs
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	storage "cloud.google.com/go/storage"
+	"github.com/rs/zerolog/log"
+)
+
+// Custom metadata keys that make an object a redirect. These are set on
+// upload with headers like "x-goog-meta-redirect-to: /new/location".
+const (
+	redirectToKey     = "redirect-to"
+	redirectStatusKey = "redirect-status"
+)
+
+// redirect is returned by objectFor when a request should be answered with a
+// redirect, rather than an object.
+type redirect struct {
+	location string
+	status   int
+}
+
+func (r *redirect) Error() string {
+	return fmt.Sprintf("redirect %d to %v", r.status, r.location)
+}
+
+// metadataRedirect returns the redirect an object's custom metadata asks for,
+// if any. The status defaults to 301 Moved Permanently. A location starting
+// with "/" is relative to the site, and is mapped to a URL by the caller.
+//
+// Since this only looks at attributes, redirects are cached along with them,
+// and the (typically empty) object's media is never read.
+func metadataRedirect(objectAttrs *storage.ObjectAttrs) *redirect {
+	location := metadataValue(objectAttrs, redirectToKey)
+	if location == "" {
+		return nil
+	}
+	status := http.StatusMovedPermanently
+	if s := metadataValue(objectAttrs, redirectStatusKey); s != "" {
+		code, err := strconv.Atoi(s)
+		switch {
+		case err != nil:
+			log.Warn().Msgf("%v: bad %v %q", objectAttrs.Name, redirectStatusKey, s)
+		case code == http.StatusMovedPermanently, code == http.StatusFound,
+			code == http.StatusTemporaryRedirect, code == http.StatusPermanentRedirect:
+			status = code
+		default:
+			log.Warn().Msgf("%v: unsupported %v %d", objectAttrs.Name, redirectStatusKey, code)
+		}
+	}
+	return &redirect{location, status}
+}
+
+// metadataValue looks up an object's custom metadata, ignoring the case of the
+// key, which is up to whatever uploaded the object.
+func metadataValue(objectAttrs *storage.ObjectAttrs, key string) string {
+	if v, ok := objectAttrs.Metadata[key]; ok {
+		return v
+	}
+	for k, v := range objectAttrs.Metadata {
+		if strings.EqualFold(k, key) {
+			return v
+		}
+	}
+	return ""
+}
@@ -0,0 +1,58 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package gcs
+
+import (
+	"net/http"
+)
+
+// deferredStatusWriter holds a status code back until the first write of the
+// body. Filters in a pipeline set headers before they write, so this lets a
+// non-200 response (e.g., 206) go out with the headers the filters leave
+// behind, rather than the ones present when the pipeline started.
+type deferredStatusWriter struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+}
+
+// withStatus wraps response so that status is sent with the first write.
+func withStatus(response http.ResponseWriter, status int) *deferredStatusWriter {
+	return &deferredStatusWriter{ResponseWriter: response, status: status}
+}
+
+// WriteHeader sends a status code, which supersedes the deferred one.
+func (w *deferredStatusWriter) WriteHeader(statusCode int) {
+	if w.wroteHeader {
+		return
+	}
+	w.wroteHeader = true
+	w.ResponseWriter.WriteHeader(statusCode)
+}
+
+// flush sends the deferred status code, if nothing has been written, as when
+// the body is empty.
+func (w *deferredStatusWriter) flush() {
+	if !w.wroteHeader {
+		w.WriteHeader(w.status)
+	}
+}
+
+// Write sends the deferred status code if needed, then writes the body.
+func (w *deferredStatusWriter) Write(p []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(w.status)
+	}
+	return w.ResponseWriter.Write(p)
+}
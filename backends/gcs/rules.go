@@ -0,0 +1,191 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package gcs
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/DomZippilli/gcs-proxy-cloud-function/rules"
+
+	storage "cloud.google.com/go/storage"
+	cache "github.com/patrickmn/go-cache"
+	"github.com/rs/zerolog/log"
+)
+
+// RulesFromBucket enables Netlify-style _redirects and _headers files at the
+// root of the bucket (or of a site's prefix; see Hosts and Mounts), which
+// rewrite, redirect and add headers by URL path.
+var RulesFromBucket = false
+
+// RulesCheckInterval is how often the rules files are checked for a new
+// generation, which is then loaded.
+var RulesCheckInterval = 30 * time.Second
+
+// The objects rules are loaded from. These are never served.
+const (
+	redirectsObject = "_redirects"
+	headersObject   = "_headers"
+)
+
+// rulesTTL is how long the rules loaded from a site are kept after they were
+// last used.
+const rulesTTL = 10 * time.Minute
+
+// siteRules are the rules loaded from a site.
+type siteRules struct {
+	sync.Mutex
+	// ready is closed once the rules have first been loaded.
+	ready               chan struct{}
+	loaded              bool
+	checked             time.Time
+	redirectsGeneration int64
+	headersGeneration   int64
+	redirects           []rules.Redirect
+	headers             []rules.Headers
+}
+
+// rulesBySite holds the rules loaded from each site, by rulesKey.
+var rulesBySite = cache.New(rulesTTL, time.Minute)
+
+// rulesKey identifies the rules of a site: those in its bucket, under its
+// prefix, as of the time it is viewed as of. Unlike the site's cache key, it
+// is the same for all callers, hosts and mounts.
+func rulesKey(s *site) string {
+	key := s.bucketName + "/" + s.prefix
+	if !s.asOf.IsZero() {
+		key += "|asof:" + s.asOf.Format(time.RFC3339Nano)
+	}
+	return key
+}
+
+// rulesFor gets the rules for a site, loading any rules file whose generation
+// has changed since it was last checked. One request checks the files at a
+// time; others use the rules already loaded, or wait for the first load.
+func rulesFor(ctx context.Context, s *site) ([]rules.Redirect, []rules.Headers) {
+	key := rulesKey(s)
+	br := &siteRules{ready: make(chan struct{})}
+	if cached, hit := rulesBySite.Get(key); hit {
+		br = cached.(*siteRules)
+	} else if err := rulesBySite.Add(key, br, cache.DefaultExpiration); err != nil {
+		// another request added them first
+		if cached, hit := rulesBySite.Get(key); hit {
+			br = cached.(*siteRules)
+		}
+	}
+	// keep them while they're in use
+	rulesBySite.SetDefault(key, br)
+
+	br.Lock()
+	stale := time.Since(br.checked) >= RulesCheckInterval
+	if stale {
+		br.checked = time.Now()
+	}
+	redirectsGeneration, headersGeneration := br.redirectsGeneration,
+		br.headersGeneration
+	br.Unlock()
+	if !stale {
+		select {
+		case <-br.ready:
+		case <-ctx.Done():
+		}
+		br.Lock()
+		defer br.Unlock()
+		return br.redirects, br.headers
+	}
+
+	// read the files without holding the lock
+	redirectsContent, redirectsGeneration, redirectsChanged := loadRulesFile(ctx,
+		s, s.prefix+redirectsObject, redirectsGeneration)
+	headersContent, headersGeneration, headersChanged := loadRulesFile(ctx, s,
+		s.prefix+headersObject, headersGeneration)
+
+	br.Lock()
+	defer br.Unlock()
+	if redirectsChanged {
+		redirects, err := rules.ParseRedirects(strings.NewReader(redirectsContent))
+		if err != nil {
+			log.Error().Msgf("rules: %v: %v", redirectsObject, err)
+		}
+		br.redirects, br.redirectsGeneration = redirects, redirectsGeneration
+	}
+	if headersChanged {
+		headers, err := rules.ParseHeaders(strings.NewReader(headersContent))
+		if err != nil {
+			log.Error().Msgf("rules: %v: %v", headersObject, err)
+		}
+		br.headers, br.headersGeneration = headers, headersGeneration
+	}
+	if !br.loaded {
+		br.loaded = true
+		close(br.ready)
+	}
+	return br.redirects, br.headers
+}
+
+// loadRulesFile reads a rules file from a site, if its generation isn't the
+// one already loaded. A missing file has generation 0, and no content. If the
+// file can't be checked, the rules already loaded are kept.
+func loadRulesFile(ctx context.Context, s *site, name string,
+	loaded int64) (content string, generation int64, changed bool) {
+	ref, err := s.resolve(ctx, objectRef{name: name})
+	var objectAttrs *storage.ObjectAttrs
+	if err == nil {
+		objectAttrs, err = s.handle(ref).Attrs(ctx)
+	}
+	if err == storage.ErrObjectNotExist {
+		return "", 0, loaded != 0
+	}
+	if err != nil {
+		log.Error().Msgf("rules: %v: %v", name, err)
+		return "", loaded, false
+	}
+	if objectAttrs.Generation == loaded {
+		return "", loaded, false
+	}
+	objectContent, err := s.bucket.Object(name).
+		Generation(objectAttrs.Generation).NewReader(ctx)
+	if err != nil {
+		log.Error().Msgf("rules: %v: %v", name, err)
+		return "", loaded, false
+	}
+	defer objectContent.Close()
+	b, err := io.ReadAll(objectContent)
+	if err != nil {
+		log.Error().Msgf("rules: %v: %v", name, err)
+		return "", loaded, false
+	}
+	log.Info().Msgf("rules: loaded %v generation %d",
+		name, objectAttrs.Generation)
+	return string(b), objectAttrs.Generation, true
+}
+
+// isRulesFile tells whether a URL path names one of the rules files.
+func isRulesFile(urlPath string) bool {
+	name := strings.TrimLeft(urlPath, "/")
+	return name == redirectsObject || name == headersObject
+}
+
+// setRuleHeaders adds the headers from matching _headers rules to a response,
+// replacing any set from object metadata.
+func setRuleHeaders(response http.ResponseWriter, headers []rules.Headers,
+	urlPath string) {
+	for name, values := range rules.MatchHeaders(headers, urlPath) {
+		response.Header().Set(name, strings.Join(values, ", "))
+	}
+}
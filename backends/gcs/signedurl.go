@@ -0,0 +1,133 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package gcs
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	storage "cloud.google.com/go/storage"
+	cache "github.com/patrickmn/go-cache"
+	"github.com/rs/zerolog/log"
+)
+
+// SignedURLRule sends matching objects straight from GCS, by redirecting to a
+// short-lived signed URL, rather than streaming them through the proxy. This
+// spares instance time and egress for big objects. Filters are not applied to
+// objects sent this way.
+//
+// An object matches a rule if it matches all the conditions the rule sets.
+// For example, this sends videos, and anything over 100MB, from GCS:
+//
+//	gcs.SignedURLRules = []gcs.SignedURLRule{
+//		{ContentType: "video/"},
+//		{MinSize: 100 << 20},
+//	}
+type SignedURLRule struct {
+	// Prefix limits the rule to URL paths under it.
+	Prefix string
+	// MinSize limits the rule to objects of at least this many bytes.
+	MinSize int64
+	// ContentType limits the rule to objects of this type, like
+	// "application/zip", or to a type ending in "/", like "video/", and all
+	// its subtypes.
+	ContentType string
+}
+
+// SignedURLRules are checked in order for each GET of an object. If one
+// matches, the response is a 302 to a V4 signed URL for the object.
+//
+// Signing needs the iam.serviceAccounts.signBlob permission on the service
+// account the proxy runs as (or a key for it, in
+// GOOGLE_APPLICATION_CREDENTIALS). For a mount or host with a ServiceAccount,
+// URLs are signed as that account, which needs the permission on itself. If
+// the URL can't be signed, the object is streamed as usual.
+var SignedURLRules []SignedURLRule
+
+// SignedURLExpiry is how long a signed URL lasts.
+var SignedURLExpiry = 15 * time.Minute
+
+// signedURLs caches signed URLs, by object, for half their lifetime, so
+// there is always time left to use one. A failure to sign is cached as "",
+// so it isn't retried on every request.
+var signedURLs = cache.New(time.Minute, 10*time.Minute)
+
+// matches tells whether an object at a URL path matches the rule.
+func (r SignedURLRule) matches(urlPath string,
+	objectAttrs *storage.ObjectAttrs) bool {
+	if !strings.HasPrefix(urlPath, r.Prefix) || objectAttrs.Size < r.MinSize {
+		return false
+	}
+	if r.ContentType == "" {
+		return true
+	}
+	contentType, _, _ := strings.Cut(objectAttrs.ContentType, ";")
+	contentType = strings.TrimSpace(contentType)
+	if strings.HasSuffix(r.ContentType, "/") {
+		return strings.HasPrefix(contentType, r.ContentType)
+	}
+	return contentType == r.ContentType
+}
+
+// signedURLFor gets a signed URL to send the object for a request from, if a
+// rule says to. Only GETs of the object itself, with a 200, are sent this way;
+// not precompressed copies.
+func signedURLFor(request *http.Request, s *site, obj *servedObject) (string,
+	bool) {
+	if len(SignedURLRules) == 0 || request.Method != http.MethodGet ||
+		obj.status != http.StatusOK || obj.encoding != "" || s.userClient != nil {
+		return "", false
+	}
+	urlPath := s.mount + s.path(request.URL.Path)
+	matched := false
+	for _, r := range SignedURLRules {
+		if r.matches(urlPath, obj.attrs) {
+			matched = true
+			break
+		}
+	}
+	if !matched {
+		return "", false
+	}
+
+	key := s.cacheKey(obj.ref) + "|" + s.billingProject
+	if signed, hit := signedURLs.Get(key); hit {
+		return signed.(string), signed.(string) != ""
+	}
+	opts := &storage.SignedURLOptions{
+		Scheme:  storage.SigningSchemeV4,
+		Method:  http.MethodGet,
+		Expires: time.Now().Add(SignedURLExpiry),
+		// sign as the service account the site is served as, if any
+		GoogleAccessID: s.serviceAccount,
+	}
+	opts.QueryParameters = url.Values{}
+	if obj.ref.generation > 0 {
+		opts.QueryParameters.Set("generation", fmt.Sprint(obj.ref.generation))
+	}
+	if s.billingProject != "" {
+		opts.QueryParameters.Set("userProject", s.billingProject)
+	}
+	signed, err := s.bucket.SignedURL(obj.ref.name, opts)
+	if err != nil {
+		log.Warn().Msgf("signed URL for %v: %v", obj.ref.name, err)
+		signedURLs.Set(key, "", cache.DefaultExpiration)
+		return "", false
+	}
+	signedURLs.Set(key, signed, SignedURLExpiry/2)
+	return signed, true
+}
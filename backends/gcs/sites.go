@@ -0,0 +1,389 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package gcs
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/DomZippilli/gcs-proxy-cloud-function/common"
+
+	storage "cloud.google.com/go/storage"
+	cache "github.com/patrickmn/go-cache"
+	"golang.org/x/oauth2"
+)
+
+// Host routes requests by their Host header to a bucket, and optionally to a
+// prefix within it, so one proxy can serve many sites.
+//
+// For example, this serves pr-123.preview.example.com from previews/123/ in
+// the preview bucket:
+//
+//	gcs.Hosts = []gcs.Host{
+//		{Host: "www.example.com", Bucket: "example-site"},
+//		{Host: "pr-*.preview.example.com", Bucket: "example-previews",
+//			Prefix: "previews/$1/"},
+//	}
+type Host struct {
+	// Host is a hostname, like "www.example.com", or a pattern where each "*"
+	// matches part of one label, like "*.preview.example.com".
+	Host string
+	// Bucket is the name of the bucket to serve.
+	Bucket string
+	// Prefix is prepended to the names of objects served. "$1", "$2", etc. are
+	// replaced with what the wildcards in Host matched.
+	Prefix string
+	// BillingProject overrides the package's BillingProject for the bucket.
+	BillingProject string
+	// ServiceAccount is the email of a service account to use the bucket as,
+	// instead of the proxy's own, which needs permission to impersonate it.
+	ServiceAccount string
+}
+
+// Hosts is the host routing table. Exact hostnames are matched first, then
+// patterns, in order. Requests for other hosts are served from BUCKET_NAME,
+// if it is set.
+var Hosts []Host
+
+// Mount serves the URL paths under a prefix from a bucket of their own,
+// regardless of host. The prefix is stripped from the path before it is
+// mapped to an object name.
+//
+// For example, this serves /assets/logo.png from logo.png in assets-bucket:
+//
+//	gcs.Mounts = []gcs.Mount{
+//		{Path: "/assets/", Bucket: "assets-bucket"},
+//		{Path: "/downloads/", Bucket: "release-bucket", Prefix: "stable/"},
+//	}
+type Mount struct {
+	// Path is the URL path prefix, like "/assets/".
+	Path string
+	// Bucket is the name of the bucket to serve.
+	Bucket string
+	// Prefix is prepended to the names of objects served.
+	Prefix string
+	// BillingProject overrides the package's BillingProject for the bucket.
+	BillingProject string
+	// ServiceAccount is the email of a service account to use the bucket as,
+	// instead of the proxy's own, which needs permission to impersonate it.
+	ServiceAccount string
+}
+
+// Mounts is the mount table. The mount with the longest matching Path serves
+// a request; requests matching no mount are routed by Hosts.
+//
+// Each mount has its own namespace in the attribute and media caches.
+var Mounts []Mount
+
+// BillingProject is the project billed for requests to requester pays
+// buckets. It is set from the BILLING_PROJECT environment variable in Setup,
+// if that is set, and may be overridden by mount or host. The proxy's
+// service account needs the serviceusage.services.use permission on it.
+var BillingProject string
+
+// BillingProjectHeader names a request header that overrides the billing
+// project, e.g., "X-Billing-Project". Only set this if a trusted frontend
+// sets the header, and strips it from clients' requests.
+var BillingProjectHeader string
+
+// projectID matches valid Google Cloud project IDs.
+var projectID = regexp.MustCompile(`^[a-z][-a-z0-9]{4,28}[a-z0-9]$`)
+
+// errNoSite is returned when nothing is configured to serve a request.
+var errNoSite = errors.New("no bucket for host")
+
+// errBadBillingProject is returned for a billing project header that isn't a
+// project ID.
+var errBadBillingProject = errors.New("invalid billing project")
+
+// site is where the objects for a request are served from.
+type site struct {
+	bucketName string
+	// bucket is used for everything done for the request.
+	bucket *storage.BucketHandle
+	// ownBucket is the bucket as the proxy itself sees it, for configuration
+	// shared by all requests, like the website. It is the same as bucket,
+	// unless the request's own credentials are used.
+	ownBucket *storage.BucketHandle
+	// client is the proxy's own client for the bucket, or one impersonating
+	// serviceAccount, if that is set.
+	client         *storage.Client
+	serviceAccount string
+	// userClient uses the request's own credentials, if they are passed
+	// through.
+	userClient *storage.Client
+	// tokens authorize requests made without a client, as the site's own
+	// client, or its userClient, if it has one.
+	tokens oauth2.TokenSource
+	// prefix is prepended to object names.
+	prefix string
+	// billingProject is billed for requests to the bucket, or "" to bill the
+	// bucket's own project.
+	billingProject string
+	// mount is the URL path the site is mounted at, without a trailing
+	// slash, or "" if it isn't a mount.
+	mount string
+	// asOf is the time the site is viewed as of, or zero for the live site.
+	asOf time.Time
+	// view is the URL path prefix that selected asOf, if any.
+	view string
+	// namespace separates the site's entries in the caches from others'.
+	namespace string
+}
+
+// path maps a URL path to a path within the site, by removing the view and
+// the mount. A mount's own path, without its trailing slash, maps to "".
+func (s *site) path(urlPath string) string {
+	return strings.TrimPrefix(strings.TrimPrefix(urlPath, s.view), s.mount)
+}
+
+// url maps a path within the site back to a URL path.
+func (s *site) url(sitePath string) string {
+	return s.view + s.mount + sitePath
+}
+
+// objectName maps a path within the site to the name of an object.
+func (s *site) objectName(sitePath string, index string) string {
+	return s.prefix + common.NormalizePathWithIndex(sitePath, index)
+}
+
+// key identifies the site, for use in cache keys.
+func (s *site) key() string {
+	return s.namespace + s.bucketName + "/" + s.prefix
+}
+
+// objectRef names an object in a site's bucket, and which generation of it
+// to use. Generation 0 is the live object.
+type objectRef struct {
+	name       string
+	generation int64
+}
+
+// handle gets a handle on the referenced object.
+func (s *site) handle(ref objectRef) *storage.ObjectHandle {
+	objectHandle := s.bucket.Object(ref.name)
+	if ref.generation > 0 {
+		objectHandle = objectHandle.Generation(ref.generation)
+	}
+	return objectHandle
+}
+
+// cacheKey is the key an object's media and metadata are cached under. Object
+// names are only unique within a bucket, so the bucket is part of the key.
+// A pinned generation never changes, so it gets a key of its own.
+func (s *site) cacheKey(ref objectRef) string {
+	cacheNamespaces.SetDefault(s.namespace+s.bucketName,
+		[2]string{s.namespace, s.bucketName})
+	return objectCacheKey(s.namespace, s.bucketName, ref)
+}
+
+// objectCacheKey is the key an object is cached under, in a namespace.
+func objectCacheKey(namespace string, bucketName string, ref objectRef) string {
+	key := namespace + bucketName + "/" + ref.name
+	if ref.generation > 0 {
+		key += "#" + fmt.Sprint(ref.generation)
+	}
+	return key
+}
+
+// cacheNamespaceTTL is how long a namespace is remembered after it was last
+// used to cache an object.
+const cacheNamespaceTTL = 24 * time.Hour
+
+// cacheNamespaces remembers the namespaces each bucket's objects have been
+// cached under, so an object that changes can be dropped from all of them.
+// Each entry is the namespace and the bucket, keyed by both.
+var cacheNamespaces = cache.New(cacheNamespaceTTL, time.Hour)
+
+// cacheNamespacesFor lists the namespaces a bucket's objects have been cached
+// under recently. The default namespace is always listed.
+func cacheNamespacesFor(bucketName string) []string {
+	namespaces := []string{""}
+	for _, item := range cacheNamespaces.Items() {
+		entry := item.Object.([2]string)
+		if entry[1] == bucketName && entry[0] != "" {
+			namespaces = append(namespaces, entry[0])
+		}
+	}
+	return namespaces
+}
+
+// hostPattern is a Host with a wildcard pattern, compiled.
+type hostPattern struct {
+	host Host
+	re   *regexp.Regexp
+}
+
+// hostPatterns caches the compiled patterns from Hosts.
+var hostPatterns struct {
+	sync.Once
+	exact    map[string]Host
+	patterns []hostPattern
+}
+
+// compileHosts sorts Hosts into exact hostnames and compiled patterns.
+func compileHosts() {
+	hostPatterns.exact = map[string]Host{}
+	for _, h := range Hosts {
+		name := strings.ToLower(h.Host)
+		if !strings.Contains(name, "*") {
+			hostPatterns.exact[name] = h
+			continue
+		}
+		parts := strings.Split(name, "*")
+		for i := range parts {
+			parts[i] = regexp.QuoteMeta(parts[i])
+		}
+		re := regexp.MustCompile("^" + strings.Join(parts, "([^.]+)") + "$")
+		hostPatterns.patterns = append(hostPatterns.patterns, hostPattern{h, re})
+	}
+}
+
+// siteFor finds the site that serves a request, and the time it is viewed as
+// of.
+func siteFor(request *http.Request) (*site, error) {
+	asOf, view, err := asOfFor(request)
+	if err != nil {
+		return nil, err
+	}
+	s, err := routeFor(request, strings.TrimPrefix(request.URL.Path, view))
+	if err != nil {
+		return nil, err
+	}
+	if PassThroughCredentials {
+		token, ok := bearerToken(request)
+		if !ok {
+			return nil, errNoCredentials
+		}
+		userClient, hash, err := userClientFor(token)
+		if err != nil {
+			return nil, err
+		}
+		s.userClient = userClient
+		s.tokens = oauth2.StaticTokenSource(&oauth2.Token{AccessToken: token})
+		s.namespace += "user:" + hash + "|"
+		s.bind()
+	}
+	if BillingProjectHeader != "" {
+		if project := request.Header.Get(BillingProjectHeader); project != "" {
+			if !projectID.MatchString(project) {
+				return nil, errBadBillingProject
+			}
+			s.bill(project)
+		}
+	}
+	if !asOf.IsZero() {
+		s.asOf, s.view = asOf, view
+		s.namespace += "asof:" + asOf.Format(time.RFC3339Nano) + "|"
+	}
+	return s, nil
+}
+
+// routeFor finds the site that serves a URL path, by mount, or by host.
+func routeFor(request *http.Request, urlPath string) (*site, error) {
+	if m, ok := mountFor(urlPath); ok {
+		s := newSite(m.Bucket, m.Prefix, m.BillingProject, m.ServiceAccount)
+		s.mount = strings.TrimSuffix(m.Path, "/")
+		s.namespace = "mount:" + s.mount + "|" + s.namespace
+		return s, nil
+	}
+
+	hostPatterns.Do(compileHosts)
+	hostname := strings.ToLower(request.Host)
+	if h, _, err := net.SplitHostPort(hostname); err == nil {
+		hostname = h
+	}
+	hostname = strings.TrimSuffix(hostname, ".")
+
+	if h, ok := hostPatterns.exact[hostname]; ok {
+		return newSite(h.Bucket, h.Prefix, h.BillingProject, h.ServiceAccount), nil
+	}
+	for _, hp := range hostPatterns.patterns {
+		if match := hp.re.FindStringSubmatch(hostname); match != nil {
+			prefix := hp.host.Prefix
+			for i := len(match) - 1; i > 0; i-- {
+				prefix = strings.ReplaceAll(prefix, "$"+fmt.Sprint(i), match[i])
+			}
+			return newSite(hp.host.Bucket, prefix, hp.host.BillingProject,
+				hp.host.ServiceAccount), nil
+		}
+	}
+	if bucket == "" {
+		return nil, errNoSite
+	}
+	return newSite(bucket, "", "", ""), nil
+}
+
+// mountFor finds the mount with the longest path matching a URL path.
+func mountFor(urlPath string) (mount Mount, ok bool) {
+	for _, m := range Mounts {
+		dir := strings.TrimSuffix(m.Path, "/")
+		if urlPath != dir && !strings.HasPrefix(urlPath, dir+"/") {
+			continue
+		}
+		if !ok || len(m.Path) > len(mount.Path) {
+			mount, ok = m, true
+		}
+	}
+	return
+}
+
+// newSite makes a site serving a bucket, under a prefix. billingProject
+// overrides BillingProject, if it is set. If serviceAccount is set, the bucket
+// is used as that service account.
+func newSite(bucketName string, prefix string, billingProject string,
+	serviceAccount string) *site {
+	s := &site{
+		bucketName:     bucketName,
+		client:         clientFor(serviceAccount),
+		tokens:         tokensFor(serviceAccount),
+		serviceAccount: serviceAccount,
+		prefix:         prefix,
+	}
+	if serviceAccount != "" {
+		// what one account may read, another may not
+		s.namespace = "sa:" + serviceAccount + "|"
+	}
+	if billingProject == "" {
+		billingProject = BillingProject
+	}
+	s.billingProject = billingProject
+	s.bind()
+	return s
+}
+
+// bill makes a project pay for the site's requests to its bucket.
+func (s *site) bill(project string) {
+	s.billingProject = project
+	s.bind()
+}
+
+// bind gets the site's bucket handles, from its clients.
+func (s *site) bind() {
+	s.ownBucket = s.client.Bucket(s.bucketName)
+	s.bucket = s.ownBucket
+	if s.userClient != nil {
+		s.bucket = s.userClient.Bucket(s.bucketName)
+	}
+	if s.billingProject != "" {
+		s.ownBucket = s.ownBucket.UserProject(s.billingProject)
+		s.bucket = s.bucket.UserProject(s.billingProject)
+	}
+}
@@ -0,0 +1,66 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package gcs
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/DomZippilli/gcs-proxy-cloud-function/common"
+	"github.com/DomZippilli/gcs-proxy-cloud-function/filter"
+)
+
+// transcodingFor works out whether an object stored with a Content-Encoding
+// has to be sent some other way, because the client doesn't accept the
+// stored encoding. If so, the response headers are changed to describe what
+// is sent instead: the media decoded, or encoded again in one of
+// filter.CompressEncodings that the client prefers. That is returned, with
+// the filter that does it, which must come first in the pipeline.
+//
+// As with GCS's decompressive transcoding, a request with no Accept-Encoding
+// gets the media decoded. Encodings the proxy can't decode are sent as they
+// are stored.
+func transcodingFor(response http.ResponseWriter, request *http.Request,
+	obj *servedObject) (transcode filter.MediaFilter, to string, ok bool) {
+	stored := obj.attrs.ContentEncoding
+	if stored == "" || obj.encoding != "" {
+		// not encoded, or a precompressed copy chosen for the client
+		return nil, "", false
+	}
+	header := response.Header()
+	common.AddVary(header, "Accept-Encoding")
+	if common.EncodingQuality(request, stored) > 0 || !filter.CanDecode(stored) {
+		return nil, "", false
+	}
+
+	to = common.NegotiateEncoding(request, filter.CompressEncodings)
+	if to == "" {
+		header.Del("Content-Encoding")
+	} else {
+		header.Set("Content-Encoding", to)
+	}
+	// the length isn't known until it's sent
+	header.Del("Content-Length")
+	// the bytes differ, but the content is the same
+	if etag := header.Get("ETag"); strings.HasPrefix(etag, `"`) {
+		header.Set("ETag", "W/"+etag)
+	}
+	return filter.Transcode(stored, to), to, true
+}
+
+// transcodedCacheKey is the media cache key for an object transcoded to an
+// encoding, kept apart from the media as stored.
+func transcodedCacheKey(key string, to string) string {
+	return key + "|transcoded:" + to
+}
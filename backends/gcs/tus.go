@@ -0,0 +1,742 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package gcs
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/DomZippilli/gcs-proxy-cloud-function/common"
+
+	storage "cloud.google.com/go/storage"
+	"github.com/rs/zerolog/log"
+	"golang.org/x/oauth2"
+	"google.golang.org/api/googleapi"
+)
+
+// TusMaxSize is the largest upload Tus will accept, in bytes.
+var TusMaxSize int64 = 5 << 40
+
+// TusChunkSize is how much of a PATCH is buffered and sent to GCS at a time,
+// as with the ChunkSize of a storage.Writer. It is rounded down to a multiple
+// of 256 KiB, which GCS requires of all but the last chunk of an upload.
+var TusChunkSize = 8 << 20
+
+// tusQuantum is what GCS requires the chunks of a resumable upload to be a
+// multiple of, all but the last.
+const tusQuantum = 256 << 10
+
+// tusVersion is the version of the tus protocol spoken.
+const tusVersion = "1.0.0"
+
+// tusExtensions are the tus protocol extensions supported.
+const tusExtensions = "creation,termination"
+
+// tusMethods are the methods Tus answers for the URL of an upload.
+const tusMethods = "OPTIONS, HEAD, PATCH, DELETE"
+
+// tusStatePrefix is where uploads in progress are kept, within a site. It is
+// also the URL path of the uploads. Objects under it are never served.
+const tusStatePrefix = ".tus/"
+
+// gcsUploadURL is the GCS JSON API endpoint resumable uploads are started at.
+const gcsUploadURL = "https://storage.googleapis.com/upload/storage/v1/b/"
+
+// The objects that make up an upload in progress, under its directory in
+// tusStatePrefix. The info object holds the upload's details in its metadata,
+// including the URL of its GCS resumable upload session. The tail object
+// holds what was received after the last chunk sent to the session, which is
+// less than a chunk.
+const (
+	tusInfoObject = "info"
+	tusTailObject = "tail"
+)
+
+// Keys of the info and tail objects' metadata.
+const (
+	tusTargetKey   = "tus-target"
+	tusLengthKey   = "tus-length"
+	tusMetadataKey = "tus-metadata"
+	tusSessionKey  = "tus-session"
+	tusDoneKey     = "tus-done"
+	tusOffsetKey   = "tus-offset"
+)
+
+// errSessionGone is returned when an upload's GCS session has expired, or
+// was cancelled.
+var errSessionGone = errors.New("tus: upload session is gone")
+
+// tusSessionClient sends chunks to resumable upload sessions. A session's URL
+// authorizes its requests, so they need no credentials. GCS answers a chunk
+// with a 308 that isn't a redirect.
+var tusSessionClient = &http.Client{
+	CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	},
+}
+
+// isTusState tells whether a path within a site is under tusStatePrefix.
+func isTusState(sitePath string) bool {
+	return strings.HasPrefix(strings.TrimLeft(sitePath, "/"), tusStatePrefix)
+}
+
+// Tus answers requests in the tus resumable upload protocol
+// (https://tus.io/protocols/resumable-upload.html), version 1.0.0, with the
+// creation and termination extensions. It claims POSTs with a Tus-Resumable
+// header, which create uploads, and OPTIONS, HEAD, PATCH and DELETE requests
+// for the URL of an upload. It returns false for other requests, which should
+// be routed as usual.
+//
+// An upload is created with a POST to the URL of the object to write. If the
+// URL is a directory, the object is named by the "filename" in the
+// Upload-Metadata header, within that directory. The object may not be a
+// rules file (see RulesFromBucket). The upload's URL is under /.tus/, and is
+// sent in the Location header.
+//
+// Each upload is a GCS resumable upload session, which PATCH requests are
+// streamed to, TusChunkSize at a time. The session's URL is kept in the
+// bucket, under .tus/, with what was received after the last chunk sent, so
+// an upload can be resumed through any instance of the proxy. Whatever part
+// of a PATCH is received is kept, even if the client goes away. A PATCH that
+// runs past the length of the upload is refused with a 413.
+//
+// GCS discards a session after a week. What is left of abandoned uploads
+// under .tus/ is small, but a lifecycle rule deleting objects there after a
+// week will clean it up.
+//
+// When an upload is done, the object is dropped from the caches, as with
+// Write.
+func Tus(ctx context.Context, response http.ResponseWriter,
+	request *http.Request, cacheDelete CacheDelete) bool {
+	s, err := siteFor(request)
+	if err != nil {
+		return false
+	}
+	sitePath := s.path(request.URL.Path)
+	var id string
+	if isTusState(sitePath) {
+		id = strings.Trim(strings.TrimPrefix(strings.TrimLeft(sitePath, "/"),
+			tusStatePrefix), "/")
+		if id == "" || strings.Contains(id, "/") {
+			return false
+		}
+		switch request.Method {
+		case http.MethodOptions, http.MethodHead, http.MethodPatch,
+			http.MethodDelete:
+		default:
+			return false
+		}
+	} else if request.Method != http.MethodPost ||
+		request.Header.Get("Tus-Resumable") == "" {
+		return false
+	}
+
+	response.Header().Set("Tus-Resumable", tusVersion)
+	if request.Method == http.MethodOptions {
+		response.Header().Set("Allow", tusMethods)
+		response.Header().Set("Tus-Version", tusVersion)
+		response.Header().Set("Tus-Extension", tusExtensions)
+		response.Header().Set("Tus-Max-Size", fmt.Sprint(TusMaxSize))
+		response.WriteHeader(http.StatusNoContent)
+		return true
+	}
+	if request.Header.Get("Tus-Resumable") != tusVersion {
+		response.Header().Set("Tus-Version", tusVersion)
+		common.Error(response, request, "", http.StatusPreconditionFailed)
+		return true
+	}
+	if !s.asOf.IsZero() {
+		// the past can't be changed
+		methodNotAllowed(response, request, s)
+		return true
+	}
+
+	if id == "" {
+		createUpload(ctx, response, request, s, sitePath, cacheDelete)
+		return true
+	}
+	u := tusUpload{s: s, dir: s.prefix + tusStatePrefix + id + "/"}
+	switch request.Method {
+	case http.MethodHead:
+		headUpload(ctx, response, request, u)
+	case http.MethodPatch:
+		patchUpload(ctx, response, request, u, cacheDelete)
+	case http.MethodDelete:
+		deleteUpload(ctx, response, request, u)
+	}
+	return true
+}
+
+// tusUpload is an upload in progress, in a site.
+type tusUpload struct {
+	s *site
+	// dir is the prefix of the upload's objects.
+	dir string
+}
+
+// tusState is how far along an upload is.
+type tusState struct {
+	info   *storage.ObjectAttrs
+	length int64
+	// committed is how much the session has stored.
+	committed int64
+	// tail holds what was received after committed, or is nil if nothing
+	// was.
+	tail *storage.ObjectAttrs
+}
+
+// offset is how much of the upload has been received.
+func (st tusState) offset() int64 {
+	if st.tail != nil {
+		return st.committed + st.tail.Size
+	}
+	return st.committed
+}
+
+// done tells whether the upload's object has been written.
+func (st tusState) done() bool {
+	return st.info.Metadata[tusDoneKey] != ""
+}
+
+// object gets a handle on one of the upload's objects.
+func (u tusUpload) object(name string) *storage.ObjectHandle {
+	return u.s.bucket.Object(u.dir + name)
+}
+
+// state reads the upload's info, and asks its session how much of it has
+// been stored. A tail left from before the session stored more is stale, and
+// ignored.
+func (u tusUpload) state(ctx context.Context) (st tusState, err error) {
+	st.info, err = u.object(tusInfoObject).Attrs(ctx)
+	if err != nil {
+		return
+	}
+	st.length, err = strconv.ParseInt(st.info.Metadata[tusLengthKey], 10, 64)
+	if err != nil {
+		err = fmt.Errorf("tus: bad length in %v: %v", st.info.Name, err)
+		return
+	}
+	if st.done() {
+		st.committed = st.length
+		return st, nil
+	}
+	st.committed, err = putChunk(ctx, st.info.Metadata[tusSessionKey], nil, 0,
+		st.length)
+	if err != nil {
+		return
+	}
+	tail, err := u.object(tusTailObject).Attrs(ctx)
+	if err == storage.ErrObjectNotExist {
+		return st, nil
+	}
+	if err != nil {
+		return
+	}
+	if tail.Metadata[tusOffsetKey] == fmt.Sprint(st.committed) {
+		st.tail = tail
+	}
+	return st, nil
+}
+
+// createUpload starts an upload of the object at a path within a site. An
+// empty upload is done as soon as it starts.
+func createUpload(ctx context.Context, response http.ResponseWriter,
+	request *http.Request, s *site, sitePath string, cacheDelete CacheDelete) {
+	length, err := strconv.ParseInt(request.Header.Get("Upload-Length"), 10, 64)
+	if err != nil || length < 0 {
+		// Upload-Defer-Length isn't supported
+		common.Error(response, request, "", http.StatusBadRequest)
+		return
+	}
+	if length > TusMaxSize {
+		common.Error(response, request, "", http.StatusRequestEntityTooLarge)
+		return
+	}
+	uploadMetadata := request.Header.Get("Upload-Metadata")
+	meta, ok := parseUploadMetadata(uploadMetadata)
+	if !ok {
+		common.Error(response, request, "", http.StatusBadRequest)
+		return
+	}
+	if isDirectory(sitePath) {
+		filename := path.Base("/" + meta["filename"])
+		if filename == "/" || filename == "." || filename == ".." {
+			common.Error(response, request, "", http.StatusBadRequest)
+			return
+		}
+		sitePath += filename
+	}
+	if isTusState(sitePath) {
+		common.Error(response, request, "", http.StatusBadRequest)
+		return
+	}
+	if isRulesFile(sitePath) {
+		common.Error(response, request, "", http.StatusForbidden)
+		return
+	}
+	website := websiteFor(ctx, s.ownBucket, s.bucketName)
+	target := s.objectName(sitePath, mainPageSuffix(website))
+
+	idBytes := make([]byte, 16)
+	if _, err := rand.Read(idBytes); err != nil {
+		log.Error().Msgf("tus: %v", err)
+		common.Error(response, request, "", http.StatusInternalServerError)
+		return
+	}
+	id := hex.EncodeToString(idBytes)
+	u := tusUpload{s: s, dir: s.prefix + tusStatePrefix + id + "/"}
+	var session string
+	if length > 0 {
+		session, err = startSession(ctx, s, target, uploadContentType(meta),
+			length)
+		if err != nil {
+			writeGoogleAPIError(response, request, err)
+			return
+		}
+	}
+	writer := u.object(tusInfoObject).If(storage.Conditions{DoesNotExist: true}).
+		NewWriter(ctx)
+	writer.ContentType = "text/plain"
+	writer.Metadata = map[string]string{
+		tusTargetKey:   target,
+		tusLengthKey:   fmt.Sprint(length),
+		tusMetadataKey: uploadMetadata,
+		tusSessionKey:  session,
+	}
+	if err := writer.Close(); err != nil {
+		log.Error().Msgf("tus: create %v: %v", target, err)
+		common.Error(response, request, "", http.StatusInternalServerError)
+		return
+	}
+	log.Info().Msgf("tus: created upload %v of %v", id, target)
+	if length == 0 {
+		// there is no data, so no session to write the object
+		empty := s.bucket.Object(target).NewWriter(ctx)
+		empty.ContentType = uploadContentType(meta)
+		err := empty.Close()
+		if err == nil {
+			err = finishUpload(ctx, u, tusState{info: writer.Attrs()},
+				cacheDelete)
+		}
+		if err != nil {
+			writeTusError(response, request, err)
+			return
+		}
+	}
+	response.Header().Set("Location", s.url("/"+tusStatePrefix+id))
+	response.WriteHeader(http.StatusCreated)
+}
+
+// headUpload tells the client how much of an upload has been received.
+func headUpload(ctx context.Context, response http.ResponseWriter,
+	request *http.Request, u tusUpload) {
+	st, err := u.state(ctx)
+	if err != nil {
+		writeTusError(response, request, err)
+		return
+	}
+	response.Header().Set("Cache-Control", "no-store")
+	response.Header().Set("Upload-Length", fmt.Sprint(st.length))
+	response.Header().Set("Upload-Offset", fmt.Sprint(st.offset()))
+	if m := st.info.Metadata[tusMetadataKey]; m != "" {
+		response.Header().Set("Upload-Metadata", m)
+	}
+	response.WriteHeader(http.StatusOK)
+}
+
+// patchUpload appends the request body to an upload, at the offset the
+// client says it is at. Once all of it has been received, the object is
+// written.
+func patchUpload(ctx context.Context, response http.ResponseWriter,
+	request *http.Request, u tusUpload, cacheDelete CacheDelete) {
+	if request.Header.Get("Content-Type") != "application/offset+octet-stream" {
+		common.Error(response, request, "", http.StatusUnsupportedMediaType)
+		return
+	}
+	clientOffset, err := strconv.ParseInt(request.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil {
+		common.Error(response, request, "", http.StatusBadRequest)
+		return
+	}
+	st, err := u.state(ctx)
+	if err != nil {
+		writeTusError(response, request, err)
+		return
+	}
+	offset := st.offset()
+	if clientOffset != offset {
+		common.Error(response, request, "", http.StatusConflict)
+		return
+	}
+	if request.ContentLength > st.length-offset {
+		common.Error(response, request, "", http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	if offset < st.length {
+		var tooLong bool
+		offset, tooLong, err = u.receive(ctx, st, request.Body)
+		if err != nil {
+			writeTusError(response, request, err)
+			return
+		}
+		if tooLong {
+			common.Error(response, request, "", http.StatusRequestEntityTooLarge)
+			return
+		}
+	}
+	if offset == st.length && !st.done() {
+		if err := finishUpload(ctx, u, st, cacheDelete); err != nil {
+			writeTusError(response, request, err)
+			return
+		}
+	}
+	response.Header().Set("Upload-Offset", fmt.Sprint(offset))
+	response.WriteHeader(http.StatusNoContent)
+}
+
+// receive streams a PATCH body to an upload's session, after what is in the
+// tail, a chunk at a time, and returns the new offset. The last chunk, which
+// makes the object, is only sent if it is all there is. Otherwise, what is
+// left over when the body ends is less than a chunk: as much of it as GCS
+// will take is sent, and the rest becomes the tail.
+//
+// A body that runs past the length of the upload isn't sent past the last
+// full chunk, and tooLong is true.
+func (u tusUpload) receive(ctx context.Context, st tusState,
+	body io.Reader) (offset int64, tooLong bool, err error) {
+	chunkSize := int64(TusChunkSize) / tusQuantum * tusQuantum
+	if chunkSize < tusQuantum {
+		chunkSize = tusQuantum
+	}
+	input := body
+	if st.tail != nil {
+		tail, err := u.object(tusTailObject).Generation(st.tail.Generation).
+			NewReader(ctx)
+		if err != nil {
+			return st.offset(), false, err
+		}
+		defer tail.Close()
+		input = io.MultiReader(tail, body)
+	}
+	session := st.info.Metadata[tusSessionKey]
+	committed := st.committed
+	buf := make([]byte, chunkSize+1)
+	for {
+		remaining := st.length - committed
+		want := chunkSize
+		if remaining <= want {
+			// read past the end, to see if there is anything there
+			want = remaining + 1
+		}
+		n, readErr := io.ReadFull(input, buf[:want])
+		chunk := buf[:n]
+		switch {
+		case int64(n) > remaining:
+			return committed, true, nil
+		case int64(n) == remaining:
+			// the rest of the upload
+			if _, err := putChunk(ctx, session, chunk, committed,
+				st.length); err != nil {
+				return committed, false, err
+			}
+			return st.length, false, nil
+		case readErr == nil:
+			// a full chunk, with more to come
+			if err := putPartialChunk(ctx, session, chunk, committed); err != nil {
+				return committed, false, err
+			}
+			committed += int64(n)
+			continue
+		case readErr != io.EOF && readErr != io.ErrUnexpectedEOF:
+			log.Warn().Msgf("tus: %v: keeping %d bytes of an interrupted PATCH: %v",
+				u.dir, n, readErr)
+		}
+
+		// the body ended short of a chunk
+		sendable := n / tusQuantum * tusQuantum
+		if sendable > 0 {
+			if err := putPartialChunk(ctx, session, chunk[:sendable],
+				committed); err != nil {
+				return committed, false, err
+			}
+			committed += int64(sendable)
+		}
+		if err := u.writeTail(ctx, st, committed, chunk[sendable:]); err != nil {
+			return committed, false, err
+		}
+		return committed + int64(n-sendable), false, nil
+	}
+}
+
+// writeTail keeps what was received after committed, replacing the tail.
+// Unless the session stored more since the tail was read, the tail must not
+// have changed since, as another PATCH would change it.
+func (u tusUpload) writeTail(ctx context.Context, st tusState, committed int64,
+	rest []byte) error {
+	if len(rest) == 0 {
+		// what the session has is all there is. A stale tail is ignored.
+		return nil
+	}
+	tail := u.object(tusTailObject)
+	if committed == st.committed {
+		if st.tail != nil {
+			tail = tail.If(storage.Conditions{GenerationMatch: st.tail.Generation})
+		} else {
+			tail = tail.If(storage.Conditions{DoesNotExist: true})
+		}
+	}
+	writer := tail.NewWriter(ctx)
+	writer.ContentType = "application/octet-stream"
+	writer.Metadata = map[string]string{tusOffsetKey: fmt.Sprint(committed)}
+	if _, err := writer.Write(rest); err != nil {
+		writer.Close()
+		return err
+	}
+	return writer.Close()
+}
+
+// finishUpload finishes an upload whose object has been written, dropping it
+// from the caches. The info is kept, marked done, so the client can still
+// check on the upload.
+func finishUpload(ctx context.Context, u tusUpload, st tusState,
+	cacheDelete CacheDelete) error {
+	target := st.info.Metadata[tusTargetKey]
+	forgetObject(u.s, objectRef{name: target}, cacheDelete)
+	log.Info().Msgf("tus: finished upload of %v", target)
+
+	done := map[string]string{}
+	for k, v := range st.info.Metadata {
+		done[k] = v
+	}
+	done[tusDoneKey] = "true"
+	if _, err := u.object(tusInfoObject).Update(ctx,
+		storage.ObjectAttrsToUpdate{Metadata: done}); err != nil {
+		return err
+	}
+	tail := u.object(tusTailObject)
+	if err := tail.Delete(ctx); err != nil && err != storage.ErrObjectNotExist {
+		log.Warn().Msgf("tus: %v: %v", tail.ObjectName(), err)
+	}
+	return nil
+}
+
+// deleteUpload terminates an upload, cancelling its session, and discarding
+// what was received.
+func deleteUpload(ctx context.Context, response http.ResponseWriter,
+	request *http.Request, u tusUpload) {
+	info, err := u.object(tusInfoObject).Attrs(ctx)
+	if err != nil {
+		writeTusError(response, request, err)
+		return
+	}
+	if session := info.Metadata[tusSessionKey]; session != "" &&
+		info.Metadata[tusDoneKey] == "" {
+		if err := cancelSession(ctx, session); err != nil {
+			log.Warn().Msgf("tus: cancel %v: %v", u.dir, err)
+		}
+	}
+	for _, name := range []string{tusTailObject, tusInfoObject} {
+		err := u.object(name).Delete(ctx)
+		if err != nil && err != storage.ErrObjectNotExist {
+			writeTusError(response, request, err)
+			return
+		}
+	}
+	response.WriteHeader(http.StatusNoContent)
+}
+
+// startSession starts a GCS resumable upload of an object in a site's bucket,
+// with the site's credentials, and returns the session's URL.
+func startSession(ctx context.Context, s *site, name string,
+	contentType string, length int64) (string, error) {
+	query := url.Values{"uploadType": {"resumable"}, "name": {name}}
+	if s.billingProject != "" {
+		query.Set("userProject", s.billingProject)
+	}
+	object := map[string]string{"name": name}
+	if contentType != "" {
+		object["contentType"] = contentType
+	}
+	body, err := json.Marshal(object)
+	if err != nil {
+		return "", err
+	}
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost,
+		gcsUploadURL+url.PathEscape(s.bucketName)+"/o?"+query.Encode(),
+		bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	request.Header.Set("Content-Type", "application/json; charset=UTF-8")
+	request.Header.Set("X-Upload-Content-Length", fmt.Sprint(length))
+	if contentType != "" {
+		request.Header.Set("X-Upload-Content-Type", contentType)
+	}
+	response, err := oauth2.NewClient(ctx, s.tokens).Do(request)
+	if err != nil {
+		return "", err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		message, _ := io.ReadAll(io.LimitReader(response.Body, 1<<10))
+		return "", &googleapi.Error{Code: response.StatusCode,
+			Message: string(message)}
+	}
+	session := response.Header.Get("Location")
+	if session == "" {
+		return "", errors.New("tus: no session URL from GCS")
+	}
+	return session, nil
+}
+
+// putChunk sends a chunk of an upload to its session, starting at offset,
+// and returns how much the session has stored. The upload is length bytes,
+// or -1 if that isn't to be given yet. A nil chunk sends nothing, and asks
+// how much has been stored.
+func putChunk(ctx context.Context, session string, chunk []byte,
+	offset int64, length int64) (committed int64, err error) {
+	total := "*"
+	if length >= 0 {
+		total = fmt.Sprint(length)
+	}
+	contentRange := "bytes */" + total
+	if len(chunk) > 0 {
+		contentRange = fmt.Sprintf("bytes %d-%d/%s", offset,
+			offset+int64(len(chunk))-1, total)
+	}
+	request, err := http.NewRequestWithContext(ctx, http.MethodPut, session,
+		bytes.NewReader(chunk))
+	if err != nil {
+		return 0, err
+	}
+	request.Header.Set("Content-Range", contentRange)
+	response, err := tusSessionClient.Do(request)
+	if err != nil {
+		return 0, err
+	}
+	defer response.Body.Close()
+	defer io.Copy(io.Discard, response.Body)
+	switch response.StatusCode {
+	case http.StatusOK, http.StatusCreated:
+		// the object has been written
+		return length, nil
+	case http.StatusPermanentRedirect:
+		// "Resume Incomplete", with the range stored, if any
+		stored := response.Header.Get("Range")
+		if stored == "" {
+			return 0, nil
+		}
+		_, end, _ := strings.Cut(strings.TrimPrefix(stored, "bytes="), "-")
+		last, err := strconv.ParseInt(end, 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("tus: bad range %q from session", stored)
+		}
+		return last + 1, nil
+	case http.StatusNotFound, http.StatusGone:
+		return 0, errSessionGone
+	default:
+		message, _ := io.ReadAll(io.LimitReader(response.Body, 1<<10))
+		return 0, &googleapi.Error{Code: response.StatusCode,
+			Message: string(message)}
+	}
+}
+
+// putPartialChunk sends a chunk that isn't the last of an upload, which must
+// all be stored.
+func putPartialChunk(ctx context.Context, session string, chunk []byte,
+	offset int64) error {
+	committed, err := putChunk(ctx, session, chunk, offset, -1)
+	if err != nil {
+		return err
+	}
+	if want := offset + int64(len(chunk)); committed != want {
+		return fmt.Errorf("tus: session stored %d bytes, not %d", committed,
+			want)
+	}
+	return nil
+}
+
+// cancelSession discards a session, and what it has stored.
+func cancelSession(ctx context.Context, session string) error {
+	request, err := http.NewRequestWithContext(ctx, http.MethodDelete, session,
+		nil)
+	if err != nil {
+		return err
+	}
+	response, err := tusSessionClient.Do(request)
+	if err != nil {
+		return err
+	}
+	response.Body.Close()
+	// GCS answers a cancelled session with a 499
+	return nil
+}
+
+// writeTusError answers a tus request that failed. A missing upload is a 404,
+// and one whose session has gone is a 410. Losing a race with another PATCH
+// to the same upload is a 409.
+func writeTusError(response http.ResponseWriter, request *http.Request,
+	err error) {
+	switch {
+	case err == storage.ErrObjectNotExist:
+		common.Error(response, request, "", http.StatusNotFound)
+	case err == errSessionGone:
+		common.Error(response, request, "", http.StatusGone)
+	case googleAPIStatus(err) == http.StatusPreconditionFailed:
+		common.Error(response, request, "", http.StatusConflict)
+	default:
+		writeGoogleAPIError(response, request, err)
+	}
+}
+
+// uploadContentType is the Content-Type of an upload's object, from its
+// Upload-Metadata.
+func uploadContentType(meta map[string]string) string {
+	if contentType := meta["filetype"]; contentType != "" {
+		return contentType
+	}
+	return meta["contentType"]
+}
+
+// parseUploadMetadata parses an Upload-Metadata header, which is a
+// comma-separated list of keys, each followed by a base64 encoded value.
+func parseUploadMetadata(header string) (map[string]string, bool) {
+	meta := map[string]string{}
+	for _, pair := range strings.Split(header, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		key, encoded, _ := strings.Cut(pair, " ")
+		value, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+		if err != nil {
+			return nil, false
+		}
+		meta[key] = string(value)
+	}
+	return meta, true
+}
@@ -0,0 +1,170 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package gcs
+
+import (
+	"context"
+	"errors"
+	"html/template"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/DomZippilli/gcs-proxy-cloud-function/common"
+	"github.com/DomZippilli/gcs-proxy-cloud-function/filter"
+
+	storage "cloud.google.com/go/storage"
+	"google.golang.org/api/iterator"
+)
+
+// ServeGenerations enables serving a specific generation of an object, given
+// by the "generation" query parameter, e.g., /index.html?generation=123. This
+// needs a bucket with versioning enabled to be of much use.
+//
+// Noncurrent generations stay readable until they are deleted from the
+// bucket, including those of objects that have since been deleted.
+var ServeGenerations = false
+
+// ListVersions enables listing all the generations of an object, given the
+// "versions" query parameter, e.g., /index.html?versions.
+var ListVersions = false
+
+// immutableCacheControl is sent with a pinned generation, whose content can
+// never change.
+const immutableCacheControl = "public, max-age=31536000, immutable"
+
+// errBadGeneration is returned for a generation that can't be parsed.
+var errBadGeneration = errors.New("invalid generation")
+
+// generationFor gets the generation a request asks to be served, or 0 for
+// the live object.
+func generationFor(request *http.Request) (int64, error) {
+	if !ServeGenerations {
+		return 0, nil
+	}
+	return queryGeneration(request)
+}
+
+// queryGeneration gets the generation given in a request's query, or 0 if
+// there is none.
+func queryGeneration(request *http.Request) (int64, error) {
+	g := request.URL.Query().Get("generation")
+	if g == "" {
+		return 0, nil
+	}
+	generation, err := strconv.ParseInt(g, 10, 64)
+	if err != nil || generation <= 0 {
+		return 0, errBadGeneration
+	}
+	return generation, nil
+}
+
+// wantsVersions tells whether a request is for a listing of versions.
+func wantsVersions(request *http.Request) bool {
+	return ListVersions && request.URL.Query().Has("versions")
+}
+
+// versionListing is a page of the generations of one object, as rendered to
+// HTML or JSON.
+type versionListing struct {
+	Name          string         `json:"name"`
+	Versions      []versionEntry `json:"versions"`
+	NextPageToken string         `json:"nextPageToken,omitempty"`
+}
+
+// versionEntry describes one generation of an object. Deleted is when the
+// generation stopped being live; it is absent for the live generation.
+type versionEntry struct {
+	Generation int64      `json:"generation"`
+	Size       int64      `json:"size"`
+	Updated    time.Time  `json:"updated"`
+	Deleted    *time.Time `json:"deleted,omitempty"`
+}
+
+// versionsTemplate renders a versionListing to HTML.
+var versionsTemplate = template.Must(template.New("versions").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Versions of /{{.Name}}</title>
+</head>
+<body>
+<h1>Versions of /{{.Name}}</h1>
+<table>
+<tr><th>Generation</th><th>Size</th><th>Updated</th><th>Deleted</th></tr>
+{{- range .Versions}}
+<tr><td><a href="?generation={{.Generation}}">{{.Generation}}</a></td><td>{{.Size}}</td><td>{{.Updated.UTC.Format "2006-01-02 15:04:05"}}</td><td>{{if .Deleted}}{{.Deleted.UTC.Format "2006-01-02 15:04:05"}}{{else}}live{{end}}</td></tr>
+{{- end}}
+</table>
+{{- if .NextPageToken}}
+<p><a href="?versions&amp;page={{.NextPageToken}}">Next page</a></p>
+{{- end}}
+</body>
+</html>
+`))
+
+// listVersions responds with a page of the generations of the object named
+// by the URL path, oldest first. The page to list is given by the "page"
+// query parameter.
+func listVersions(ctx context.Context, response http.ResponseWriter,
+	request *http.Request, s *site, pipeline filter.Pipeline) {
+	website := websiteFor(ctx, s.ownBucket, s.bucketName)
+	objectName := s.objectName(s.path(request.URL.Path), mainPageSuffix(website))
+
+	// the offsets bound the listing to exactly this name
+	query := &storage.Query{
+		Versions:    true,
+		StartOffset: objectName,
+		EndOffset:   objectName + "\x00",
+	}
+	query.SetAttrSelection([]string{"Name", "Size", "Updated", "Deleted",
+		"Generation"})
+	it := s.bucket.Objects(ctx, query)
+
+	var page []*storage.ObjectAttrs
+	pageToken := request.URL.Query().Get("page")
+	nextPageToken, err := iterator.NewPager(it, AutoindexPageSize, pageToken).
+		NextPage(&page)
+	if err != nil {
+		writeGoogleAPIError(response, request, err)
+		return
+	}
+
+	l := versionListing{
+		Name:          strings.TrimPrefix(objectName, s.prefix),
+		Versions:      []versionEntry{},
+		NextPageToken: nextPageToken,
+	}
+	for _, attrs := range page {
+		if attrs.Name != objectName {
+			continue
+		}
+		entry := versionEntry{
+			Generation: attrs.Generation,
+			Size:       attrs.Size,
+			Updated:    attrs.Updated,
+		}
+		if !attrs.Deleted.IsZero() {
+			deleted := attrs.Deleted
+			entry.Deleted = &deleted
+		}
+		l.Versions = append(l.Versions, entry)
+	}
+	if len(l.Versions) == 0 && pageToken == "" {
+		common.Error(response, request, "", http.StatusNotFound)
+		return
+	}
+	renderListing(ctx, response, request, l, versionsTemplate, pipeline)
+}
@@ -0,0 +1,97 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package gcs
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	storage "cloud.google.com/go/storage"
+	"github.com/rs/zerolog/log"
+)
+
+// defaultMainPageSuffix is used when a bucket has no website configuration.
+const defaultMainPageSuffix = "index.html"
+
+// WebsiteRefreshInterval is how often buckets' website configurations
+// (MainPageSuffix and NotFoundPage) are re-read.
+var WebsiteRefreshInterval = 5 * time.Minute
+
+// knownWebsite is a bucket's website configuration, with the handle used to
+// refresh it.
+type knownWebsite struct {
+	bucketHandle *storage.BucketHandle
+	website      storage.BucketWebsite
+}
+
+// websites holds the website configuration of each bucket served, by name.
+var websites = struct {
+	sync.RWMutex
+	byBucket map[string]knownWebsite
+}{byBucket: map[string]knownWebsite{}}
+
+// loadWebsite reads a bucket's website configuration. If the bucket's
+// attributes can't be read (reading them takes storage.buckets.get, which
+// object readers often lack), the defaults are used.
+func loadWebsite(ctx context.Context, bucketHandle *storage.BucketHandle,
+	bucketName string) storage.BucketWebsite {
+	website := storage.BucketWebsite{}
+	bucketAttrs, err := bucketHandle.Attrs(ctx)
+	if err != nil {
+		log.Warn().Msgf("website config for %v: %v", bucketName, err)
+	} else if bucketAttrs.Website != nil {
+		website = *bucketAttrs.Website
+	}
+	websites.Lock()
+	websites.byBucket[bucketName] = knownWebsite{bucketHandle, website}
+	websites.Unlock()
+	return website
+}
+
+// websiteFor gets a bucket's website configuration, reading it the first time.
+func websiteFor(ctx context.Context, bucketHandle *storage.BucketHandle,
+	bucketName string) storage.BucketWebsite {
+	websites.RLock()
+	known, ok := websites.byBucket[bucketName]
+	websites.RUnlock()
+	if !ok {
+		return loadWebsite(ctx, bucketHandle, bucketName)
+	}
+	return known.website
+}
+
+// refreshWebsites re-reads the website configuration of every known bucket,
+// every WebsiteRefreshInterval. It doesn't return.
+func refreshWebsites() {
+	for range time.Tick(WebsiteRefreshInterval) {
+		websites.RLock()
+		known := make(map[string]*storage.BucketHandle, len(websites.byBucket))
+		for bucketName, k := range websites.byBucket {
+			known[bucketName] = k.bucketHandle
+		}
+		websites.RUnlock()
+		for bucketName, bucketHandle := range known {
+			loadWebsite(context.Background(), bucketHandle, bucketName)
+		}
+	}
+}
+
+// mainPageSuffix is the object name appended to directory paths.
+func mainPageSuffix(website storage.BucketWebsite) string {
+	if website.MainPageSuffix != "" {
+		return website.MainPageSuffix
+	}
+	return defaultMainPageSuffix
+}
@@ -0,0 +1,323 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package gcs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/DomZippilli/gcs-proxy-cloud-function/backends/proxy"
+	"github.com/DomZippilli/gcs-proxy-cloud-function/common"
+	"github.com/DomZippilli/gcs-proxy-cloud-function/filter"
+
+	storage "cloud.google.com/go/storage"
+	"github.com/rs/zerolog/log"
+	"google.golang.org/api/googleapi"
+)
+
+// CacheDelete defines how Write will remove media from the cache.
+type CacheDelete func(string)
+
+// metadataHeaderPrefix starts the request headers that set custom metadata,
+// as in the GCS XML API.
+const metadataHeaderPrefix = "X-Goog-Meta-"
+
+// generationMatchHeader makes a write conditional on the live generation of
+// the object, as in the GCS XML API. Generation 0 means there must be none.
+const generationMatchHeader = "X-Goog-If-Generation-Match"
+
+// errBadPrecondition is returned for preconditions that can't be parsed, or
+// that contradict each other.
+var errBadPrecondition = errors.New("invalid precondition")
+
+// AcceptWrites lets Write and WriteWithFilters store objects. Allowing PUT or
+// POST in proxy.AllowedMethods isn't enough on its own, since POST is also
+// allowed for form uploads, which don't need this.
+var AcceptWrites = false
+
+// Write stores the body of a request as the object the URL maps to, streaming
+// it to GCS. Content-Type, Cache-Control, Content-Disposition,
+// Content-Encoding and Content-Language are kept with the object, as is
+// custom metadata from X-Goog-Meta-* headers.
+//
+// "If-None-Match: *" only writes the object if it doesn't exist yet, and
+// X-Goog-If-Generation-Match only writes it if the live generation matches.
+//
+// The response is a 201 for a new object, or a 200 for one that replaced an
+// object. Once written, the object's metadata and media are dropped from the
+// caches of every site serving it. cacheDelete removes media from the cache
+// that ReadWithCache is given.
+//
+// Unless AcceptWrites is on, the response is a 405.
+//
+// The pipeline is applied to the (empty) response body.
+func Write(ctx context.Context, response http.ResponseWriter,
+	request *http.Request, pipeline filter.Pipeline, cacheDelete CacheDelete) {
+	WriteWithFilters(ctx, response, request, filter.Pipeline{}, pipeline,
+		cacheDelete)
+}
+
+// WriteWithFilters works like Write, but applies the filters in
+// ingestPipeline to the request body on its way to GCS, e.g., to compress it,
+// or to scan it and refuse it.
+//
+// In ingestPipeline, the filters' response headers are the object's: they
+// start out as the request's, and whatever they are when the first byte is
+// written is kept with the object. So a filter may change the Content-Type,
+// or set custom metadata with X-Goog-Meta-* headers. A filter that sends an
+// error status (e.g., with filter.FilterError) abandons the write, and the
+// status is sent in response. A filter that returns an error, or a body that
+// is cut short, abandons it too.
+func WriteWithFilters(ctx context.Context, response http.ResponseWriter,
+	request *http.Request, ingestPipeline filter.Pipeline,
+	pipeline filter.Pipeline, cacheDelete CacheDelete) {
+	if !AcceptWrites {
+		methodNotAllowed(response, request, nil)
+		return
+	}
+	s, err := siteFor(request)
+	if err != nil {
+		writeObjectError(ctx, response, request, s, err, pipeline)
+		return
+	}
+	if !s.asOf.IsZero() {
+		// the past can't be changed
+		methodNotAllowed(response, request, s)
+		return
+	}
+	if isTusState(s.path(request.URL.Path)) {
+		// uploads in progress are managed by Tus
+		common.Error(response, request, "", http.StatusForbidden)
+		return
+	}
+	website := websiteFor(ctx, s.ownBucket, s.bucketName)
+	ref := objectRef{name: s.objectName(s.path(request.URL.Path),
+		mainPageSuffix(website))}
+
+	conditions, err := writeConditions(request)
+	if err != nil {
+		common.Error(response, request, "", http.StatusBadRequest)
+		return
+	}
+	objectHandle := s.handle(ref)
+	if conditions != (storage.Conditions{}) {
+		objectHandle = objectHandle.If(conditions)
+	}
+	replacing, err := replaces(ctx, s, ref, conditions)
+	if err != nil {
+		writeGoogleAPIError(response, request, err)
+		return
+	}
+
+	// stream the body to GCS. Cancelling the context abandons the write.
+	writeCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	writer := objectHandle.NewWriter(writeCtx)
+	ingest := newIngestWriter(writer, request.Header, cancel)
+	if len(ingestPipeline) > 0 {
+		// use a filter pipeline
+		_, err = filter.PipelineCopy(ctx, ingest, request.Body, request,
+			ingestPipeline)
+	} else {
+		// unfiltered, simple copy
+		_, err = io.Copy(ingest, request.Body)
+	}
+	if status := ingest.refused(); status != 0 {
+		writer.Close()
+		log.Warn().Msgf("write %v: refused by filter with %d", ref.name, status)
+		common.Error(response, request, "", status)
+		return
+	}
+	if err != nil {
+		cancel()
+		writer.Close()
+		log.Error().Msgf("write %v: %v", ref.name, err)
+		common.Error(response, request, "", http.StatusInternalServerError)
+		return
+	}
+	ingest.start()
+	err = writer.Close()
+
+	// whatever was cached is stale now, even if the write failed partway
+	forgetObject(s, ref, cacheDelete)
+
+	if err != nil {
+		writeGoogleAPIError(response, request, err)
+		return
+	}
+	objectAttrs := writer.Attrs()
+	response.Header().Set("ETag", objectETag(objectAttrs))
+	response.Header().Set("X-Goog-Generation", fmt.Sprint(objectAttrs.Generation))
+	if replacing {
+		response.WriteHeader(http.StatusOK)
+	} else {
+		response.WriteHeader(http.StatusCreated)
+	}
+
+	// send the (empty) body
+	media := strings.NewReader("")
+	if len(pipeline) > 0 {
+		// use a filter pipeline
+		_, err = filter.PipelineCopy(ctx, response, media, request, pipeline)
+	} else {
+		// unfiltered, simple copy
+		_, err = io.Copy(response, media)
+	}
+	if err != nil {
+		log.Error().Msgf("Write: %v", err)
+	}
+}
+
+// forgetObject drops an object's metadata and media from the caches, in
+// every namespace its bucket has been cached under: other hosts and mounts
+// may serve the same bucket, and other callers may have their own.
+func forgetObject(s *site, ref objectRef, cacheDelete CacheDelete) {
+	for _, namespace := range cacheNamespacesFor(s.bucketName) {
+		key := objectCacheKey(namespace, s.bucketName, ref)
+		objectMetadataCache.Delete(key)
+		missingCopies.Delete(key)
+		cacheDelete(key)
+		for _, to := range append([]string{""}, filter.CompressEncodings...) {
+			cacheDelete(transcodedCacheKey(key, to))
+		}
+	}
+}
+
+// replaces tells whether a write will replace an object, rather than create
+// it. Without a precondition that says, the object is looked up.
+func replaces(ctx context.Context, s *site, ref objectRef,
+	conditions storage.Conditions) (bool, error) {
+	switch {
+	case conditions.DoesNotExist:
+		return false, nil
+	case conditions.GenerationMatch != 0:
+		return true, nil
+	}
+	_, err := s.handle(ref).Attrs(ctx)
+	if err == storage.ErrObjectNotExist {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// methodNotAllowed refuses a request with a 405. The Allow header lists the
+// methods in proxy.AllowedMethods that are turned on here, and, for a site
+// given, that it accepts; a past view of a site only accepts reads.
+func methodNotAllowed(response http.ResponseWriter, request *http.Request,
+	s *site) {
+	var allow []string
+	for _, m := range proxy.AllowedMethods {
+		switch m {
+		case http.MethodOptions, http.MethodGet, http.MethodHead:
+		case http.MethodPut:
+			if !AcceptWrites || (s != nil && !s.asOf.IsZero()) {
+				continue
+			}
+		case http.MethodPost:
+			if !(AcceptWrites || FormPolicies != nil) ||
+				(s != nil && !s.asOf.IsZero()) {
+				continue
+			}
+		case http.MethodDelete:
+			if !AcceptDeletes || (s != nil && !s.asOf.IsZero()) {
+				continue
+			}
+		}
+		allow = append(allow, m)
+	}
+	response.Header().Set("Allow", strings.Join(allow, ", "))
+	common.Error(response, request, "", http.StatusMethodNotAllowed)
+}
+
+// writeConditions gets the preconditions for a write from the request headers.
+func writeConditions(request *http.Request) (conditions storage.Conditions,
+	err error) {
+	if inm := request.Header.Get("If-None-Match"); inm != "" {
+		if strings.TrimSpace(inm) != "*" {
+			return conditions, errBadPrecondition
+		}
+		conditions.DoesNotExist = true
+	}
+	if gm := request.Header.Get(generationMatchHeader); gm != "" {
+		generation, err := strconv.ParseInt(gm, 10, 64)
+		if err != nil || generation < 0 || conditions.DoesNotExist {
+			return conditions, errBadPrecondition
+		}
+		if generation == 0 {
+			conditions.DoesNotExist = true
+		} else {
+			conditions.GenerationMatch = generation
+		}
+	}
+	return conditions, nil
+}
+
+// setWriterAttrs sets the attributes of an object being written from the
+// headers of the request writing it.
+func setWriterAttrs(objectAttrs *storage.ObjectAttrs, header http.Header) {
+	objectAttrs.ContentType = header.Get("Content-Type")
+	objectAttrs.CacheControl = header.Get("Cache-Control")
+	objectAttrs.ContentDisposition = header.Get("Content-Disposition")
+	objectAttrs.ContentEncoding = header.Get("Content-Encoding")
+	objectAttrs.ContentLanguage = header.Get("Content-Language")
+	for name, values := range header {
+		if !strings.HasPrefix(name, metadataHeaderPrefix) || len(values) == 0 {
+			continue
+		}
+		if objectAttrs.Metadata == nil {
+			objectAttrs.Metadata = map[string]string{}
+		}
+		key := strings.ToLower(strings.TrimPrefix(name, metadataHeaderPrefix))
+		objectAttrs.Metadata[key] = strings.Join(values, ", ")
+	}
+}
+
+// writeGoogleAPIError answers a request that GCS refused, passing on failed
+// preconditions and missing objects, and, with PassThroughCredentials, refused
+// credentials. Anything else is a 500.
+func writeGoogleAPIError(response http.ResponseWriter, request *http.Request,
+	err error) {
+	status := googleAPIStatus(err)
+	switch {
+	case err == storage.ErrObjectNotExist:
+		common.Error(response, request, "", http.StatusNotFound)
+	case status == http.StatusPreconditionFailed || status == http.StatusNotFound:
+		common.Error(response, request, "", status)
+	case PassThroughCredentials && (status == http.StatusUnauthorized ||
+		status == http.StatusForbidden):
+		// the caller's own credentials were refused
+		if status == http.StatusUnauthorized {
+			response.Header().Set("WWW-Authenticate", "Bearer")
+		}
+		common.Error(response, request, "", status)
+	default:
+		log.Error().Msgf("%v %v: %v", request.Method, request.URL.Path, err)
+		common.Error(response, request, "", http.StatusInternalServerError)
+	}
+}
+
+// googleAPIStatus is the HTTP status code of an error from a GCS API, or 0 if
+// it isn't one.
+func googleAPIStatus(err error) int {
+	var apiErr *googleapi.Error
+	if errors.As(err, &apiErr) {
+		return apiErr.Code
+	}
+	return 0
+}
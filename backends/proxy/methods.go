@@ -0,0 +1,53 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package proxy
+
+import (
+	"net/http"
+	"strings"
+)
+
+// AllowedMethods are the HTTP methods the proxy answers, and advertises in
+// OPTIONS responses. Requests with other methods are refused with a 405.
+var AllowedMethods = []string{
+	http.MethodOptions,
+	http.MethodGet,
+	http.MethodHead,
+}
+
+// AllowMethods adds methods to AllowedMethods, unless they are already there,
+// so features that need the same method can each allow it.
+func AllowMethods(methods ...string) {
+	for _, m := range methods {
+		if !Allowed(m) {
+			AllowedMethods = append(AllowedMethods, m)
+		}
+	}
+}
+
+// Allowed tells whether method is one of AllowedMethods.
+func Allowed(method string) bool {
+	for _, m := range AllowedMethods {
+		if m == method {
+			return true
+		}
+	}
+	return false
+}
+
+// MethodNotAllowed refuses a request whose method isn't allowed.
+func MethodNotAllowed(response http.ResponseWriter) {
+	response.Header().Set("Allow", strings.Join(AllowedMethods, ", "))
+	http.Error(response, "405 - Method Not Allowed", http.StatusMethodNotAllowed)
+}
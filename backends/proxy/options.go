@@ -29,7 +29,7 @@ import (
 // body contents, which is in error), but logging is still ok.
 func SendOptions(ctx context.Context, response http.ResponseWriter,
 	request *http.Request, pipeline filter.Pipeline) {
-	response.Header().Add("Allow", "OPTIONS, GET, HEAD")
+	response.Header().Add("Allow", strings.Join(AllowedMethods, ", "))
 	response.WriteHeader(http.StatusNoContent)
 	media := strings.NewReader("")
 	err := error(nil)
@@ -18,6 +18,7 @@ import (
 	"net/http"
 	"os"
 
+	"github.com/DomZippilli/gcs-proxy-cloud-function/backends/proxy"
 	"github.com/DomZippilli/gcs-proxy-cloud-function/config"
 	"github.com/rs/zerolog/log"
 	"golang.org/x/net/http2"
@@ -53,15 +54,29 @@ func main() {
 // permits HTTP protocol usage of a GCS bucket's contents.
 func ProxyHTTPGCS(output http.ResponseWriter, input *http.Request) {
 	ctx := context.Background()
+	// some requests are handled regardless of method, like uploads
+	if config.INTERCEPT(ctx, output, input) {
+		return
+	}
+	if !proxy.Allowed(input.Method) {
+		proxy.MethodNotAllowed(output)
+		return
+	}
 	// route HTTP methods to appropriate handlers.
 	switch input.Method {
 	case http.MethodGet:
 		config.GET(ctx, output, input)
 	case http.MethodHead:
 		config.HEAD(ctx, output, input)
+	case http.MethodPut:
+		config.PUT(ctx, output, input)
+	case http.MethodPost:
+		config.POST(ctx, output, input)
+	case http.MethodDelete:
+		config.DELETE(ctx, output, input)
 	case http.MethodOptions:
 		config.OPTIONS(ctx, output, input)
 	default:
-		http.Error(output, "405 - Method Not Allowed", http.StatusMethodNotAllowed)
+		proxy.MethodNotAllowed(output)
 	}
 }
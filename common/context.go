@@ -0,0 +1,35 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package common
+
+import (
+	"context"
+)
+
+// cacheKeyType is the context key for a media cache key.
+type cacheKeyType struct{}
+
+// WithCacheKey returns a context carrying the key that media for a request is
+// cached under. Backends set this when the key isn't just the URL path, e.g.,
+// when objects come from more than one bucket.
+func WithCacheKey(ctx context.Context, key string) context.Context {
+	return context.WithValue(ctx, cacheKeyType{}, key)
+}
+
+// CacheKey gets the key that media for a request is cached under, if a backend
+// has set one.
+func CacheKey(ctx context.Context) (string, bool) {
+	key, ok := ctx.Value(cacheKeyType{}).(string)
+	return key, ok
+}
@@ -0,0 +1,107 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package common
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// AcceptedEncodings parses a request's Accept-Encoding header into the
+// q-value of each content coding it names, in lower case. "*" stands for the
+// codings it doesn't name, and "x-gzip" is taken as "gzip".
+func AcceptedEncodings(request *http.Request) map[string]float64 {
+	accepted := map[string]float64{}
+	for _, header := range request.Header.Values("Accept-Encoding") {
+		for _, item := range strings.Split(header, ",") {
+			coding, params, _ := strings.Cut(item, ";")
+			coding = strings.ToLower(strings.TrimSpace(coding))
+			if coding == "" {
+				continue
+			}
+			if coding == "x-gzip" {
+				coding = "gzip"
+			}
+			q := 1.0
+			for _, param := range strings.Split(params, ";") {
+				name, value, _ := strings.Cut(param, "=")
+				if strings.TrimSpace(name) != "q" {
+					continue
+				}
+				if parsed, err := strconv.ParseFloat(strings.TrimSpace(value),
+					64); err == nil && parsed >= 0 && parsed <= 1 {
+					q = parsed
+				} else {
+					q = 0
+				}
+			}
+			accepted[coding] = q
+		}
+	}
+	return accepted
+}
+
+// EncodingQuality is the q-value a request gives a content coding, from 0,
+// for not acceptable, to 1. Identity is acceptable unless it is refused.
+func EncodingQuality(request *http.Request, coding string) float64 {
+	return encodingQuality(AcceptedEncodings(request), strings.ToLower(coding))
+}
+
+func encodingQuality(accepted map[string]float64, coding string) float64 {
+	if coding == "x-gzip" {
+		coding = "gzip"
+	}
+	if q, ok := accepted[coding]; ok {
+		return q
+	}
+	if q, ok := accepted["*"]; ok {
+		return q
+	}
+	if coding == "identity" {
+		return 1
+	}
+	return 0
+}
+
+// NegotiateEncoding picks the content coding to respond to a request with,
+// from those offered, which are in order of preference. The client's
+// q-values come first; the order of the offer breaks ties. "" means none of
+// them are acceptable, or the client prefers the content unencoded.
+func NegotiateEncoding(request *http.Request, offered []string) string {
+	accepted := AcceptedEncodings(request)
+	// identity only wins if the client says how much it wants it
+	best, bestQ := "", accepted["identity"]
+	for _, coding := range offered {
+		q := encodingQuality(accepted, strings.ToLower(coding))
+		if q > 0 && (q > bestQ || (best == "" && q == bestQ)) {
+			best, bestQ = coding, q
+		}
+	}
+	return best
+}
+
+// AddVary adds a request header name to a response's Vary header, if it isn't
+// there already.
+func AddVary(header http.Header, name string) {
+	for _, value := range header.Values("Vary") {
+		for _, field := range strings.Split(value, ",") {
+			field = strings.TrimSpace(field)
+			if field == "*" || strings.EqualFold(field, name) {
+				return
+			}
+		}
+	}
+	header.Add("Vary", name)
+}
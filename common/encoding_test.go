@@ -0,0 +1,129 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package common
+
+import (
+	"net/http"
+	"reflect"
+	"testing"
+)
+
+// requestAccepting makes a request with an Accept-Encoding header for each
+// of values.
+func requestAccepting(values ...string) *http.Request {
+	request, _ := http.NewRequest(http.MethodGet, "/", nil)
+	for _, value := range values {
+		request.Header.Add("Accept-Encoding", value)
+	}
+	return request
+}
+
+func TestAcceptedEncodings(t *testing.T) {
+	tests := []struct {
+		header string
+		want   map[string]float64
+	}{
+		{"", map[string]float64{}},
+		{"gzip, br;q=0.5", map[string]float64{"gzip": 1, "br": 0.5}},
+		{"GZip, BR", map[string]float64{"gzip": 1, "br": 1}},
+		{"x-gzip;q=0.4", map[string]float64{"gzip": 0.4}},
+		{"identity;q=0", map[string]float64{"identity": 0}},
+		{"*;q=0.1", map[string]float64{"*": 0.1}},
+		{"gzip; q = 0.3", map[string]float64{"gzip": 0.3}},
+		{"gzip;level=1", map[string]float64{"gzip": 1}},
+		{" , ,", map[string]float64{}},
+		// malformed q-values aren't acceptable
+		{"gzip;q=", map[string]float64{"gzip": 0}},
+		{"gzip;q=high", map[string]float64{"gzip": 0}},
+		{"gzip;q=2", map[string]float64{"gzip": 0}},
+		{"gzip;q=-1", map[string]float64{"gzip": 0}},
+	}
+	for _, tc := range tests {
+		got := AcceptedEncodings(requestAccepting(tc.header))
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("AcceptedEncodings(%q) = %v; want %v", tc.header, got,
+				tc.want)
+		}
+	}
+}
+
+func TestEncodingQuality(t *testing.T) {
+	tests := []struct {
+		header string
+		coding string
+		want   float64
+	}{
+		// identity is acceptable unless it is refused
+		{"", "identity", 1},
+		{"", "gzip", 0},
+		{"gzip", "identity", 1},
+		{"identity;q=0", "identity", 0},
+		{"*;q=0", "identity", 0},
+		{"*;q=0, identity", "identity", 1},
+		// "*" stands for what isn't named
+		{"*;q=0.3", "br", 0.3},
+		{"*;q=0.3, br;q=0", "br", 0},
+		{"gzip;q=0.7", "GZIP", 0.7},
+		{"X-GZIP;q=0.2", "x-gzip", 0.2},
+	}
+	for _, tc := range tests {
+		got := EncodingQuality(requestAccepting(tc.header), tc.coding)
+		if got != tc.want {
+			t.Errorf("EncodingQuality(%q, %q) = %v; want %v", tc.header,
+				tc.coding, got, tc.want)
+		}
+	}
+}
+
+func TestNegotiateEncoding(t *testing.T) {
+	offered := []string{"br", "zstd", "gzip"}
+	tests := []struct {
+		headers []string
+		want    string
+	}{
+		{nil, ""},
+		{[]string{"gzip"}, "gzip"},
+		{[]string{"x-gzip"}, "gzip"},
+		{[]string{"GZIP"}, "gzip"},
+		// the offer's order breaks ties
+		{[]string{"gzip, br"}, "br"},
+		{[]string{"gzip;q=0.8, zstd;q=0.8"}, "zstd"},
+		{[]string{"*"}, "br"},
+		// the client's q-values come first
+		{[]string{"gzip;q=1, br;q=0.5"}, "gzip"},
+		{[]string{"*;q=0.5, gzip"}, "gzip"},
+		{[]string{"gzip", "br;q=0.1"}, "gzip"},
+		// q=0 refuses a coding
+		{[]string{"br;q=0, gzip"}, "gzip"},
+		{[]string{"*;q=0"}, ""},
+		{[]string{"*, br;q=0"}, "zstd"},
+		// identity only wins if it is preferred
+		{[]string{"identity;q=1, gzip;q=0.5"}, ""},
+		{[]string{"identity;q=0.5, gzip"}, "gzip"},
+		{[]string{"identity;q=0.5, gzip;q=0.5"}, "gzip"},
+		{[]string{"identity;q=0, gzip"}, "gzip"},
+		// malformed q-values aren't acceptable
+		{[]string{"gzip;q=abc"}, ""},
+		{[]string{"gzip;q=2, br;q=0.1"}, "br"},
+		// codings that aren't offered don't count
+		{[]string{"deflate, compress"}, ""},
+	}
+	for _, tc := range tests {
+		got := NegotiateEncoding(requestAccepting(tc.headers...), offered)
+		if got != tc.want {
+			t.Errorf("NegotiateEncoding(%q) = %q; want %q", tc.headers, got,
+				tc.want)
+		}
+	}
+}
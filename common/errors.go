@@ -0,0 +1,36 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package common
+
+import (
+	"net/http"
+)
+
+// ErrorPageWriter sends a custom error page for a status code, returning false
+// if it has none, in which case a plain error is sent.
+type ErrorPageWriter func(response http.ResponseWriter, request *http.Request,
+	statusCode int) bool
+
+// ErrorPageHandler writes custom error pages, if a backend has set one up.
+var ErrorPageHandler ErrorPageWriter
+
+// Error replies to the request with the custom error page for the status code,
+// if there is one. Otherwise, it works like http.Error.
+func Error(response http.ResponseWriter, request *http.Request, msg string,
+	statusCode int) {
+	if ErrorPageHandler != nil && ErrorPageHandler(response, request, statusCode) {
+		return
+	}
+	http.Error(response, msg, statusCode)
+}
@@ -17,17 +17,23 @@ import (
 	"fmt"
 	"io"
 	"net/http"
-    "strings"
+	"strings"
 )
 
 // NormalizePath:
 //   replace trailing slashes with "/index.html";
 //   remove leading slashes.
 func NormalizePath(path string) (object string) {
-    if strings.HasSuffix(path, "/") {
-        path = path + "index.html"
-    }
-    return strings.TrimLeft(path, "/")
+	return NormalizePathWithIndex(path, "index.html")
+}
+
+// NormalizePathWithIndex is NormalizePath, but with a different index object
+// name for trailing slashes, like a bucket's website MainPageSuffix.
+func NormalizePathWithIndex(path string, index string) (object string) {
+	if strings.HasSuffix(path, "/") {
+		path = path + index
+	}
+	return strings.TrimLeft(path, "/")
 }
 
 func GetRuntimeProjectId() (string, error) {
@@ -23,9 +23,39 @@ import (
 
 // Setup will be called once at the start of the program.
 func Setup() error {
+	// list directories that have no index.html
+	//gcs.Autoindex = true
+	// read and write with callers' own OAuth tokens, not the proxy's identity
+	//gcs.PassThroughCredentials = true
+	// serve precompressed copies, like app.js.br, to clients that take them
+	//gcs.ServePrecompressed = true
+	// guess the types of objects stored without one from their first bytes
+	//gcs.SniffContentTypes = true
+	// accept uploads with PUT and POST
+	//proxy.AllowMethods(http.MethodPut, http.MethodPost)
+	//gcs.AcceptWrites = true
+	// accept deletes
+	//proxy.AllowMethods(http.MethodDelete)
+	//gcs.AcceptDeletes = true
+	// tus resumable uploads (see INTERCEPT) need no methods allowed here
 	return gcs.Setup()
 }
 
+// INTERCEPT will be called in main.go for requests of any method, before they
+// are checked against proxy.AllowedMethods and routed by method. It returns
+// whether it answered the request.
+func INTERCEPT(ctx context.Context, output http.ResponseWriter, input *http.Request) bool {
+	// tus resumable uploads
+	//if gcs.Tus(ctx, output, input, cacheDeleter) {
+	//	return true
+	//}
+	// policies for browser form uploads (see POST)
+	//if gcs.IssueFormPolicy(ctx, output, input) {
+	//	return true
+	//}
+	return false
+}
+
 // GET will be called in main.go for GET requests
 func GET(ctx context.Context, output http.ResponseWriter, input *http.Request) {
 	gcs.Read(ctx, output, input, LoggingOnly)
@@ -37,9 +67,27 @@ func HEAD(ctx context.Context, output http.ResponseWriter, input *http.Request)
 	gcs.ReadMetadata(ctx, output, input, LoggingOnly)
 }
 
-// func POST
+// PUT will be called in main.go for PUT requests, if PUT is allowed
+func PUT(ctx context.Context, output http.ResponseWriter, input *http.Request) {
+	gcs.Write(ctx, output, input, LoggingOnly, cacheDeleter)
+	//gcs.WriteWithFilters(ctx, output, input, BlockSSNs, LoggingOnly, cacheDeleter)
+}
+
+// POST will be called in main.go for POST requests, if POST is allowed
+func POST(ctx context.Context, output http.ResponseWriter, input *http.Request) {
+	// browser form uploads with policies from gcs.IssueFormPolicy. Other
+	// POSTs go on to gcs.Write, which refuses them with a 405 unless
+	// gcs.AcceptWrites is on, in which case it writes them without a policy.
+	//if gcs.FormUpload(ctx, output, input, LoggingOnly, cacheDeleter) {
+	//	return
+	//}
+	gcs.Write(ctx, output, input, LoggingOnly, cacheDeleter)
+}
 
-// func DELETE
+// DELETE will be called in main.go for DELETE requests, if DELETE is allowed
+func DELETE(ctx context.Context, output http.ResponseWriter, input *http.Request) {
+	gcs.Delete(ctx, output, input, LoggingOnly, cacheDeleter)
+}
 
 // OPTIONS will be called in main.go for OPTIONS requests
 func OPTIONS(ctx context.Context, output http.ResponseWriter, input *http.Request) {
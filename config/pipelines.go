@@ -40,12 +40,19 @@ var LowercasingProxy = filter.Pipeline{
 	filter.LogRequest,
 }
 
-// EXAMPLE: Send everything compressed.
+// EXAMPLE: Send everything gzipped, to clients that accept it.
 var ZippingProxy = filter.Pipeline{
 	filter.GZip,
 	filter.LogRequest,
 }
 
+// EXAMPLE: Send everything compressed as the client prefers, of Brotli, zstd
+// and gzip.
+var CompressingProxy = filter.Pipeline{
+	filter.Compress,
+	filter.LogRequest,
+}
+
 // EXAMPLE: Translate HTML files from English to Spanish dynamically.
 var DynamicTranslationFromEnToEs = filter.Pipeline{
 	htmlEnglishToSpanish,
@@ -111,6 +118,11 @@ func cacheGetter(k string) ([]byte, bool) {
 	return []byte{}, false
 }
 
+// cacheDeleter matches the gcs.CacheDelete type.
+func cacheDeleter(k string) {
+	mediaCache.Delete(k)
+}
+
 // cacheMedia applies mediaCache to the FillCache filter.
 func cacheMedia(c context.Context, mfh filter.MediaFilterHandle) error {
 	return filter.FillCache(c, mfh, cacheSetter)
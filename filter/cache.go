@@ -18,6 +18,7 @@ import (
 	"context"
 	"fmt"
 	"io"
+	"net/http"
 	"strconv"
 	"strings"
 	"time"
@@ -28,9 +29,16 @@ import (
 
 type CacheSet func(string, []byte, time.Duration)
 
-// FillCache will tee the media it recieves into a cache, using the normalized
-// request URL as the key. Supply a cache setter with the setter argument.
+// FillCache will tee the media it recieves into a cache, using the key the
+// backend put in the context, or else the normalized request URL. Supply a
+// cache setter with the setter argument.
+//
+// Partial (ranged) responses, and those marked "Cache-Control: no-store", are
+// passed through without being cached.
 func FillCache(ctx context.Context, handle MediaFilterHandle, setter CacheSet) error {
+	if !cacheable(handle.response.Header()) {
+		return NoOp(ctx, handle)
+	}
 	defer handle.input.Close()
 	defer handle.output.Close()
 	// create a buffer for the media
@@ -54,7 +62,20 @@ func FillCache(ctx context.Context, handle MediaFilterHandle, setter CacheSet) e
 		}
 	}
 	// cache the media
-	cacheKey := common.NormalizePath(handle.request.URL.String())
+	cacheKey, ok := common.CacheKey(ctx)
+	if !ok {
+		cacheKey = common.NormalizePath(handle.request.URL.String())
+	}
 	setter(cacheKey, cachedMedia.Bytes(), cacheExpiration)
 	return nil
 }
+
+// cacheable tells whether a response may be cached, going by its headers.
+// Partial content responses hold only some of the media, so they can't be.
+func cacheable(header http.Header) bool {
+	if header.Get("Content-Range") != "" ||
+		strings.HasPrefix(header.Get("Content-Type"), "multipart/byteranges") {
+		return false
+	}
+	return !strings.Contains(header.Get("Cache-Control"), "no-store")
+}
@@ -0,0 +1,147 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package filter
+
+import (
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/DomZippilli/gcs-proxy-cloud-function/common"
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+)
+
+// CompressEncodings are the content codings Compress offers, in order of
+// preference when the client likes them equally.
+var CompressEncodings = []string{"br", "zstd", "gzip"}
+
+// CompressMinSize is the smallest media, in bytes, worth compressing. Media
+// of unknown size is always compressed.
+var CompressMinSize int64 = 1024
+
+// IncompressibleTypes are content types that are compressed already, and
+// aren't made smaller by Compress. A type ending in "/" stands for all its
+// subtypes.
+var IncompressibleTypes = []string{
+	"image/", "video/", "audio/", "font/woff", "font/woff2",
+	"application/zip", "application/gzip", "application/x-gzip",
+	"application/zstd", "application/x-bzip2", "application/x-xz",
+	"application/x-7z-compressed", "application/x-rar-compressed",
+	"application/pdf", "application/octet-stream",
+}
+
+// compressibleTypes are exceptions to IncompressibleTypes.
+var compressibleTypes = []string{"image/svg+xml", "image/bmp",
+	"image/x-icon", "image/vnd.microsoft.icon"}
+
+// Compress encodes the media with the best of CompressEncodings that the
+// client's Accept-Encoding allows, or leaves it be, if it allows none of
+// them. Media that is encoded already, partial content, media of
+// IncompressibleTypes, and media smaller than CompressMinSize are passed
+// through as they are.
+//
+// Put this after FillCache in a pipeline, so what's cached can be sent to
+// clients that accept different encodings.
+func Compress(ctx context.Context, handle MediaFilterHandle) error {
+	return compressWith(ctx, handle, CompressEncodings)
+}
+
+// compressWith applies Compress, offering only some encodings.
+func compressWith(ctx context.Context, handle MediaFilterHandle,
+	offered []string) error {
+	header := handle.response.Header()
+	if !compressible(header) {
+		return NoOp(ctx, handle)
+	}
+	// the encoding depends on what the client accepts
+	common.AddVary(header, "Accept-Encoding")
+	encoding := common.NegotiateEncoding(handle.request, offered)
+	if encoding == "" {
+		return NoOp(ctx, handle)
+	}
+
+	defer handle.input.Close()
+	defer handle.output.Close()
+	encoder, err := newEncoder(handle.output, encoding)
+	if err != nil {
+		return FilterError(handle, http.StatusInternalServerError,
+			"compress filter: %v", err)
+	}
+	// delete content-length header. It is no longer accurate.
+	header.Del("Content-Length")
+	// the bytes differ, but the content is the same: a weak tag still matches
+	// If-None-Match
+	if etag := header.Get("ETag"); strings.HasPrefix(etag, `"`) {
+		header.Set("ETag", "W/"+etag)
+	}
+	header.Set("Content-Encoding", encoding)
+	_, err = io.Copy(encoder, handle.input)
+	if closeErr := encoder.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("compress filter: %v", err)
+	}
+	return nil
+}
+
+// newEncoder makes a writer that encodes what is written to it with a content
+// coding, and writes that to w. Closing it finishes the encoding, but leaves w
+// open.
+func newEncoder(w io.Writer, encoding string) (io.WriteCloser, error) {
+	switch encoding {
+	case "br":
+		return brotli.NewWriterLevel(w, 5), nil
+	case "zstd":
+		return zstd.NewWriter(w)
+	case "gzip":
+		return gzip.NewWriterLevel(w, 6)
+	}
+	return nil, fmt.Errorf("unknown encoding %v", encoding)
+}
+
+// compressible tells whether media, going by the response headers, is worth
+// compressing.
+func compressible(header http.Header) bool {
+	if header.Get("Content-Encoding") != "" || header.Get("Content-Range") != "" {
+		return false
+	}
+	if length, err := strconv.ParseInt(header.Get("Content-Length"), 10,
+		64); err == nil && length < CompressMinSize {
+		return false
+	}
+	mediaType, _, err := mime.ParseMediaType(header.Get("Content-Type"))
+	if err != nil {
+		// no type, or one that can't be read; it may well compress
+		return true
+	}
+	for _, t := range compressibleTypes {
+		if mediaType == t {
+			return true
+		}
+	}
+	for _, t := range IncompressibleTypes {
+		if mediaType == t || (strings.HasSuffix(t, "/") &&
+			strings.HasPrefix(mediaType, t)) {
+			return false
+		}
+	}
+	return !strings.HasPrefix(mediaType, "multipart/")
+}
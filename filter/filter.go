@@ -18,7 +18,9 @@ import (
 	"fmt"
 	"io"
 	"net/http"
+	"sync"
 
+	"github.com/DomZippilli/gcs-proxy-cloud-function/common"
 	"github.com/rs/zerolog/log"
 )
 
@@ -39,15 +41,32 @@ type MediaFilterHandle struct {
 }
 
 // Performs a copy of input to response, with filters applied to the input.
+// An error reading the input, or returned by a filter, is returned once the
+// filters are done, so callers can tell the media was cut short.
 func PipelineCopy(ctx context.Context, response http.ResponseWriter, input io.Reader, request *http.Request, pipeline Pipeline) (int64, error) {
+	// keep the first error, from the input or any filter
+	var mu sync.Mutex
+	var firstErr error
+	fail := func(err error) {
+		mu.Lock()
+		defer mu.Unlock()
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
 	inputReader, inputWriter := io.Pipe()
 	// prime the pump by writing the input to the first pipe
 	go func() {
-		io.Copy(inputWriter, input)
-		inputWriter.Close()
+		_, err := io.Copy(inputWriter, input)
+		if err != nil && err != io.ErrClosedPipe {
+			// the filters see the error, not the end of the media
+			fail(err)
+		}
+		inputWriter.CloseWithError(err)
 	}()
 	// variable for last pipe's reader (output) in outer scope
 	var lastFilterReader *io.PipeReader
+	var filters sync.WaitGroup
 	for i, filter := range pipeline {
 		// make a new pipe
 		filterReader, filterWriter := io.Pipe()
@@ -59,7 +78,13 @@ func PipelineCopy(ctx context.Context, response http.ResponseWriter, input io.Re
 			inputSource = lastFilterReader
 		}
 		// run filter goroutine
-		go filter(ctx, MediaFilterHandle{
+		filters.Add(1)
+		go func(filter MediaFilter, handle MediaFilterHandle) {
+			defer filters.Done()
+			if err := filter(ctx, handle); err != nil {
+				fail(err)
+			}
+		}(filter, MediaFilterHandle{
 			input:    inputSource,
 			output:   filterWriter,
 			request:  request,
@@ -68,7 +93,16 @@ func PipelineCopy(ctx context.Context, response http.ResponseWriter, input io.Re
 		// update last filter pipereader for next filter or output
 		lastFilterReader = filterReader
 	}
-	return io.Copy(response, lastFilterReader)
+	written, err := io.Copy(response, lastFilterReader)
+	// if the response failed, the filters must stop writing to it
+	lastFilterReader.Close()
+	filters.Wait()
+	if err == nil {
+		mu.Lock()
+		err = firstErr
+		mu.Unlock()
+	}
+	return written, err
 }
 
 // NoOp does nothing to the media.
@@ -94,6 +128,6 @@ func FilterIf(ctx context.Context, handle MediaFilterHandle,
 func FilterError(handle MediaFilterHandle, statusCode int, msg string, v ...interface{}) error {
 	err := fmt.Errorf(msg, v...)
 	log.Error().Msgf("filter error! %v", err)
-	http.Error(handle.response, http.StatusText(statusCode), statusCode)
+	common.Error(handle.response, handle.request, http.StatusText(statusCode), statusCode)
 	return err
 }
@@ -20,6 +20,7 @@ import (
 	"net/http"
 	"regexp"
 
+	"github.com/DomZippilli/gcs-proxy-cloud-function/common"
 	"github.com/rs/zerolog/log"
 )
 
@@ -58,7 +59,8 @@ func BlockRegex(ctx context.Context, handle MediaFilterHandle, regexes []*regexp
 			match := re.Match(buffer.Bytes())
 			if match {
 				// BLOCK -- not an error, but we stop the response right now
-				http.Error(handle.response, "PROHIBITED REGEX PATTERN MATCHED", http.StatusGone)
+				common.Error(handle.response, handle.request,
+					"PROHIBITED REGEX PATTERN MATCHED", http.StatusGone)
 				log.Warn().Msgf("blockregex: matched %v", re.String())
 				return nil
 			}
@@ -0,0 +1,92 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package filter
+
+import (
+	"compress/gzip"
+	"compress/zlib"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+)
+
+// CanDecode tells whether Transcode can decode media in a content coding.
+func CanDecode(encoding string) bool {
+	switch strings.ToLower(encoding) {
+	case "gzip", "x-gzip", "deflate", "br", "zstd":
+		return true
+	}
+	return false
+}
+
+// Transcode makes a filter that decodes media stored in one content coding,
+// from, and encodes it in another, to, which is one of CompressEncodings, or
+// "" to send it decoded. This is like the decompressive transcoding GCS does
+// for gzip, for clients that don't accept the stored encoding.
+//
+// The filter only changes the media. The response headers should already say
+// what it sends, without a Content-Length.
+func Transcode(from string, to string) MediaFilter {
+	return func(ctx context.Context, handle MediaFilterHandle) error {
+		defer handle.input.Close()
+		defer handle.output.Close()
+		decoded, err := newDecoder(handle.input, from)
+		if err != nil {
+			return FilterError(handle, http.StatusInternalServerError,
+				"transcode filter: %v", err)
+		}
+		defer decoded.Close()
+		var output io.Writer = handle.output
+		if to != "" {
+			encoder, err := newEncoder(handle.output, to)
+			if err != nil {
+				return FilterError(handle, http.StatusInternalServerError,
+					"transcode filter: %v", err)
+			}
+			defer encoder.Close()
+			output = encoder
+		}
+		if _, err := io.Copy(output, decoded); err != nil {
+			// the headers are gone; all that can be done is to cut it short
+			handle.output.CloseWithError(err)
+			return fmt.Errorf("transcode filter: %v", err)
+		}
+		return nil
+	}
+}
+
+// newDecoder makes a reader that decodes what it reads from r, in a content
+// coding.
+func newDecoder(r io.Reader, encoding string) (io.ReadCloser, error) {
+	switch strings.ToLower(encoding) {
+	case "gzip", "x-gzip":
+		return gzip.NewReader(r)
+	case "deflate":
+		return zlib.NewReader(r)
+	case "br":
+		return io.NopCloser(brotli.NewReader(r)), nil
+	case "zstd":
+		decoder, err := zstd.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		return decoder.IOReadCloser(), nil
+	}
+	return nil, fmt.Errorf("unknown encoding %v", encoding)
+}
@@ -14,29 +14,15 @@
 package filter
 
 import (
-	"compress/gzip"
 	"context"
-	"io"
-	"net/http"
 )
 
-// GZip applies gzip encoding to the media.
+// GZip applies gzip encoding to the media, if the client accepts it. Like
+// Compress, it leaves alone media that is encoded already, or wouldn't be
+// made smaller.
 //
 // This is an example of a streaming filter. This will use very little memory
 // and add very little latency to responses.
 func GZip(ctx context.Context, handle MediaFilterHandle) error {
-	defer handle.input.Close()
-	defer handle.output.Close()
-	// delete content-length header. It is no longer accurate.
-	handle.response.Header().Del("Content-Length")
-	// add a content-encoding
-	handle.response.Header().Set("Content-Encoding", "gzip")
-	// zip the content
-	gz, err := gzip.NewWriterLevel(handle.output, 6)
-	if err != nil {
-		return FilterError(handle, http.StatusInternalServerError, "zip filter: %v", err)
-	}
-	defer gz.Close()
-	io.Copy(gz, handle.input)
-	return nil
+	return compressWith(ctx, handle, []string{"gzip"})
 }
@@ -0,0 +1,83 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package rules
+
+import (
+	"bufio"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Headers is a rule from a _headers file, adding headers to responses for
+// paths that match a pattern.
+type Headers struct {
+	For    Pattern
+	Values http.Header
+}
+
+// ParseHeaders parses a _headers file. Each rule is a path pattern, followed
+// by indented header lines:
+//
+//	/assets/*
+//	  Cache-Control: public, max-age=31536000, immutable
+//	  X-Robots-Tag: noindex
+//
+// Blank lines and lines starting with "#" are ignored.
+func ParseHeaders(r io.Reader) ([]Headers, error) {
+	var headers []Headers
+	scanner := bufio.NewScanner(r)
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		text := scanner.Text()
+		line := strings.TrimSpace(text)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		indented := text[0] == ' ' || text[0] == '\t'
+		if !indented {
+			headers = append(headers, Headers{
+				For:    ParsePattern(line),
+				Values: http.Header{},
+			})
+			continue
+		}
+		name, value, ok := strings.Cut(line, ":")
+		if !ok || len(headers) == 0 {
+			log.Warn().Msgf("_headers line %d: bad header %q", lineNumber, line)
+			continue
+		}
+		headers[len(headers)-1].Values.Add(strings.TrimSpace(name),
+			strings.TrimSpace(value))
+	}
+	return headers, scanner.Err()
+}
+
+// MatchHeaders collects the headers of all the rules matching a path. When
+// more than one rule sets a header, the values are combined.
+func MatchHeaders(headers []Headers, path string) http.Header {
+	matched := http.Header{}
+	for _, h := range headers {
+		if _, ok := h.For.Match(path); !ok {
+			continue
+		}
+		for name, values := range h.Values {
+			for _, value := range values {
+				matched.Add(name, value)
+			}
+		}
+	}
+	return matched
+}
@@ -0,0 +1,72 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package rules
+
+import (
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestMatchHeaders(t *testing.T) {
+	headers, err := ParseHeaders(strings.NewReader(`
+# comments and blank lines are skipped
+
+/*
+  X-Frame-Options: DENY
+  Link: </style.css>; rel=preload
+
+/assets/*
+	Cache-Control: public, max-age=31536000, immutable
+  Link: </font.woff2>; rel=preload
+  not a header
+
+/blog/:slug
+  X-Robots-Tag: noindex
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(headers) != 3 {
+		t.Fatalf("ParseHeaders got %d rules; want 3", len(headers))
+	}
+	tests := []struct {
+		path string
+		want http.Header
+	}{
+		{"/index.html", http.Header{
+			"X-Frame-Options": {"DENY"},
+			"Link":            {"</style.css>; rel=preload"},
+		}},
+		// values from all matching rules are combined
+		{"/assets/app.js", http.Header{
+			"X-Frame-Options": {"DENY"},
+			"Link": {"</style.css>; rel=preload",
+				"</font.woff2>; rel=preload"},
+			"Cache-Control": {"public, max-age=31536000, immutable"},
+		}},
+		{"/blog/hello", http.Header{
+			"X-Frame-Options": {"DENY"},
+			"Link":            {"</style.css>; rel=preload"},
+			"X-Robots-Tag":    {"noindex"},
+		}},
+	}
+	for _, tc := range tests {
+		if got := MatchHeaders(headers, tc.path); !reflect.DeepEqual(got,
+			tc.want) {
+			t.Errorf("MatchHeaders(%q) = %v; want %v", tc.path, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,98 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package rules
+
+import (
+	"sort"
+	"strings"
+)
+
+// splat is the name the value matched by a "*" is substituted for.
+const splat = "splat"
+
+// Pattern is a URL path pattern, in the style of Netlify's _redirects and
+// _headers files. Segments starting with ":" are placeholders, which match any
+// one segment, and a final "*" (a splat) matches the rest of the path.
+//
+// For example, "/blog/:year/*" matches "/blog/2021/05/hello", capturing
+// "2021" as :year and "05/hello" as :splat.
+type Pattern struct {
+	raw      string
+	segments []string
+	splat    bool
+}
+
+// ParsePattern parses a URL path pattern.
+func ParsePattern(s string) Pattern {
+	p := Pattern{raw: s}
+	trimmed := strings.Trim(s, "/")
+	if strings.HasSuffix(trimmed, "*") {
+		p.splat = true
+		trimmed = strings.TrimSuffix(strings.TrimSuffix(trimmed, "*"), "/")
+	}
+	if trimmed != "" {
+		p.segments = strings.Split(trimmed, "/")
+	}
+	return p
+}
+
+// String returns the pattern as it was written.
+func (p Pattern) String() string {
+	return p.raw
+}
+
+// Match matches a URL path against the pattern, returning the values captured
+// by placeholders and the splat. Trailing slashes don't matter.
+func (p Pattern) Match(path string) (params map[string]string, ok bool) {
+	trimmed := strings.Trim(path, "/")
+	var segments []string
+	if trimmed != "" {
+		segments = strings.Split(trimmed, "/")
+	}
+	if len(segments) < len(p.segments) ||
+		(!p.splat && len(segments) != len(p.segments)) {
+		return nil, false
+	}
+	params = map[string]string{}
+	for i, want := range p.segments {
+		if strings.HasPrefix(want, ":") {
+			params[want[1:]] = segments[i]
+		} else if want != segments[i] {
+			return nil, false
+		}
+	}
+	if p.splat {
+		params[splat] = strings.Join(segments[len(p.segments):], "/")
+	}
+	return params, true
+}
+
+// expand substitutes captured values for the placeholders (":name") in s.
+// Longer names are substituted first, so ":id" doesn't clobber ":idx".
+func expand(s string, params map[string]string) string {
+	if !strings.Contains(s, ":") {
+		return s
+	}
+	names := make([]string, 0, len(params))
+	for name := range params {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		return len(names[i]) > len(names[j])
+	})
+	for _, name := range names {
+		s = strings.ReplaceAll(s, ":"+name, params[name])
+	}
+	return s
+}
@@ -0,0 +1,85 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package rules
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestPatternMatch(t *testing.T) {
+	tests := []struct {
+		pattern string
+		path    string
+		params  map[string]string
+		ok      bool
+	}{
+		{"/about", "/about", map[string]string{}, true},
+		{"/about", "/about/", map[string]string{}, true},
+		{"/about", "/about/team", nil, false},
+		{"/about", "/contact", nil, false},
+		{"/", "/", map[string]string{}, true},
+		{"/", "/about", nil, false},
+		{"/blog/:year/:slug", "/blog/2021/hello",
+			map[string]string{"year": "2021", "slug": "hello"}, true},
+		{"/blog/:year/:slug", "/blog/2021", nil, false},
+		{"/blog/:year/:slug", "/news/2021/hello", nil, false},
+		{"/blog/*", "/blog/2021/05/hello",
+			map[string]string{"splat": "2021/05/hello"}, true},
+		{"/blog/*", "/blog", map[string]string{"splat": ""}, true},
+		{"/blog/*", "/blogs/hello", nil, false},
+		{"/blog/:year/*", "/blog/2021/05/hello",
+			map[string]string{"year": "2021", "splat": "05/hello"}, true},
+		{"/*", "/anything/at/all",
+			map[string]string{"splat": "anything/at/all"}, true},
+	}
+	for _, tc := range tests {
+		params, ok := ParsePattern(tc.pattern).Match(tc.path)
+		if ok != tc.ok || (ok && !reflect.DeepEqual(params, tc.params)) {
+			t.Errorf("%q.Match(%q) = %v, %v; want %v, %v", tc.pattern, tc.path,
+				params, ok, tc.params, tc.ok)
+		}
+	}
+}
+
+func TestPatternString(t *testing.T) {
+	for _, s := range []string{"/blog/:year/*", "/about/", "/"} {
+		if got := ParsePattern(s).String(); got != s {
+			t.Errorf("ParsePattern(%q).String() = %q", s, got)
+		}
+	}
+}
+
+func TestExpand(t *testing.T) {
+	tests := []struct {
+		s      string
+		params map[string]string
+		want   string
+	}{
+		{"/static", map[string]string{"id": "1"}, "/static"},
+		{"/posts/:id", map[string]string{"id": "1"}, "/posts/1"},
+		{"/news/:splat", map[string]string{"splat": "a/b"}, "/news/a/b"},
+		// longer names go first, so :id doesn't clobber :idx
+		{"/:idx/:id", map[string]string{"id": "1", "idx": "2"}, "/2/1"},
+		{"/:id/:idx", map[string]string{"idx": "2", "id": "1"}, "/1/2"},
+		// placeholders without a value are left alone
+		{"/:year/:slug", map[string]string{"year": "2021"}, "/2021/:slug"},
+	}
+	for _, tc := range tests {
+		if got := expand(tc.s, tc.params); got != tc.want {
+			t.Errorf("expand(%q, %v) = %q; want %q", tc.s, tc.params, got,
+				tc.want)
+		}
+	}
+}
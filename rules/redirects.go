@@ -0,0 +1,190 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package rules
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Redirect is a rule from a _redirects file. A rule with a 3xx status is a
+// redirect; 200 is a rewrite, serving the target in place of the path; and
+// 404 serves the target as a not found page.
+//
+// Unless forced (written with a "!" after the status), a rule only applies
+// when there is no object at the path, so it can't shadow real content.
+type Redirect struct {
+	From   Pattern
+	Query  map[string]string
+	To     string
+	Status int
+	Force  bool
+}
+
+// Target is the result of a matched Redirect.
+type Target struct {
+	// Location is the redirect location, or the path to rewrite to.
+	Location string
+	Status   int
+	Force    bool
+}
+
+// IsRewrite tells whether the target is to be served in place of the path,
+// rather than redirected to.
+func (t Target) IsRewrite() bool {
+	return t.Status == http.StatusOK || t.Status == http.StatusNotFound
+}
+
+// ParseRedirects parses a _redirects file. Each line is a rule:
+//
+//	/from [param=value...] /to [status[!]]
+//
+// Blank lines and lines starting with "#" are ignored, as are rules this
+// proxy can't follow (like Netlify's country conditions, or proxying to
+// other sites), which are logged.
+func ParseRedirects(r io.Reader) ([]Redirect, error) {
+	var redirects []Redirect
+	scanner := bufio.NewScanner(r)
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		redirect, err := parseRedirect(strings.Fields(line))
+		if err != nil {
+			log.Warn().Msgf("_redirects line %d: %v", lineNumber, err)
+			continue
+		}
+		redirects = append(redirects, redirect)
+	}
+	return redirects, scanner.Err()
+}
+
+// parseRedirect parses the fields of one _redirects rule.
+func parseRedirect(fields []string) (redirect Redirect, err error) {
+	if len(fields) < 2 {
+		return redirect, fmt.Errorf("missing target")
+	}
+	if !strings.HasPrefix(fields[0], "/") {
+		return redirect, fmt.Errorf("unsupported source %q", fields[0])
+	}
+	redirect.From = ParsePattern(fields[0])
+	redirect.Status = http.StatusMovedPermanently
+
+	// query parameters to match come before the target
+	i := 1
+	for ; i < len(fields) && !isTarget(fields[i]); i++ {
+		name, value, ok := strings.Cut(fields[i], "=")
+		if !ok {
+			return redirect, fmt.Errorf("bad query parameter %q", fields[i])
+		}
+		if redirect.Query == nil {
+			redirect.Query = map[string]string{}
+		}
+		redirect.Query[name] = value
+	}
+	if i == len(fields) {
+		return redirect, fmt.Errorf("missing target")
+	}
+	redirect.To = fields[i]
+	i++
+
+	// then the status, and any conditions, which aren't supported
+	if i < len(fields) {
+		status := fields[i]
+		if strings.HasSuffix(status, "!") {
+			redirect.Force = true
+			status = strings.TrimSuffix(status, "!")
+		}
+		redirect.Status, err = strconv.Atoi(status)
+		if err != nil {
+			return redirect, fmt.Errorf("bad status %q", fields[i])
+		}
+		i++
+	}
+	if i < len(fields) {
+		return redirect, fmt.Errorf("unsupported conditions %v", fields[i:])
+	}
+
+	switch {
+	case redirect.Status == http.StatusOK || redirect.Status == http.StatusNotFound:
+		if !strings.HasPrefix(redirect.To, "/") {
+			return redirect, fmt.Errorf("can't proxy to %q", redirect.To)
+		}
+	case redirect.Status < 300 || redirect.Status > 399:
+		return redirect, fmt.Errorf("unsupported status %d", redirect.Status)
+	}
+	return redirect, nil
+}
+
+// isTarget tells whether a field of a _redirects rule is its target.
+func isTarget(field string) bool {
+	return strings.HasPrefix(field, "/") || strings.Contains(field, "://")
+}
+
+// Match matches a request path and query against the rule, returning the
+// target with captured values filled in.
+//
+// Query parameters in the rule must all be present. A value starting with ":"
+// captures the parameter's value; otherwise it must match exactly. A redirect
+// passes the query string along, unless the rule matched on it or the target
+// has its own.
+func (r Redirect) Match(path string, query url.Values) (target Target, ok bool) {
+	params, ok := r.From.Match(path)
+	if !ok {
+		return target, false
+	}
+	for name, want := range r.Query {
+		if !query.Has(name) {
+			return target, false
+		}
+		got := query.Get(name)
+		if strings.HasPrefix(want, ":") {
+			params[want[1:]] = got
+		} else if got != want {
+			return target, false
+		}
+	}
+	target = Target{
+		Location: expand(r.To, params),
+		Status:   r.Status,
+		Force:    r.Force,
+	}
+	if target.IsRewrite() {
+		// rewrites name objects; a query string has no bearing on that
+		target.Location, _, _ = strings.Cut(target.Location, "?")
+	} else if len(r.Query) == 0 && len(query) > 0 &&
+		!strings.Contains(target.Location, "?") {
+		target.Location += "?" + query.Encode()
+	}
+	return target, true
+}
+
+// MatchRedirects finds the first rule that matches a request path and query.
+func MatchRedirects(redirects []Redirect, path string, query url.Values) (
+	target Target, ok bool) {
+	for _, r := range redirects {
+		if target, ok = r.Match(path, query); ok {
+			return
+		}
+	}
+	return
+}
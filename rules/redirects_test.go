@@ -0,0 +1,176 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package rules
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestParseRedirect(t *testing.T) {
+	tests := []struct {
+		line   string
+		to     string
+		query  map[string]string
+		status int
+		force  bool
+		ok     bool
+	}{
+		{"/old /new", "/new", nil, http.StatusMovedPermanently, false, true},
+		{"/old /new 302", "/new", nil, http.StatusFound, false, true},
+		{"/old https://example.com/new 301", "https://example.com/new", nil,
+			http.StatusMovedPermanently, false, true},
+		{"/app/* /index.html 200", "/index.html", nil, http.StatusOK, false,
+			true},
+		{"/gone /404.html 404", "/404.html", nil, http.StatusNotFound, false,
+			true},
+		{"/old /new 200!", "/new", nil, http.StatusOK, true, true},
+		{"/old /new 301!", "/new", nil, http.StatusMovedPermanently, true, true},
+		{"/store id=:id /products/:id 301", "/products/:id",
+			map[string]string{"id": ":id"}, http.StatusMovedPermanently, false,
+			true},
+		{"/old", "", nil, 0, false, false},
+		{"old /new", "", nil, 0, false, false},
+		{"/old id=1", "", nil, 0, false, false},
+		{"/old id /new", "", nil, 0, false, false},
+		{"/old /new abc", "", nil, 0, false, false},
+		{"/old /new 500", "", nil, 0, false, false},
+		{"/old /new 200 Country=us", "", nil, 0, false, false},
+		{"/api/* https://api.example.com/:splat 200", "", nil, 0, false, false},
+	}
+	for _, tc := range tests {
+		r, err := parseRedirect(strings.Fields(tc.line))
+		if (err == nil) != tc.ok {
+			t.Errorf("parseRedirect(%q) error = %v; want ok %v", tc.line, err,
+				tc.ok)
+			continue
+		}
+		if !tc.ok {
+			continue
+		}
+		if r.To != tc.to || r.Status != tc.status || r.Force != tc.force ||
+			len(r.Query) != len(tc.query) {
+			t.Errorf("parseRedirect(%q) = %+v; want to %q, status %d, force %v",
+				tc.line, r, tc.to, tc.status, tc.force)
+		}
+		for name, value := range tc.query {
+			if r.Query[name] != value {
+				t.Errorf("parseRedirect(%q) query %q = %q; want %q", tc.line,
+					name, r.Query[name], value)
+			}
+		}
+	}
+}
+
+func TestParseRedirects(t *testing.T) {
+	file := `
+# comments and blank lines are skipped
+
+/a /b
+/unsupported /x 200 Role=admin
+	/c  /d  302
+`
+	redirects, err := ParseRedirects(strings.NewReader(file))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(redirects) != 2 || redirects[0].To != "/b" ||
+		redirects[1].To != "/d" || redirects[1].Status != http.StatusFound {
+		t.Errorf("ParseRedirects = %+v", redirects)
+	}
+}
+
+func TestRedirectMatch(t *testing.T) {
+	tests := []struct {
+		rule     string
+		path     string
+		query    string
+		location string
+		ok       bool
+	}{
+		{"/old /new", "/old", "", "/new", true},
+		{"/old /new", "/other", "", "", false},
+		{"/blog/:year/:slug /posts/:year-:slug", "/blog/2021/hello", "",
+			"/posts/2021-hello", true},
+		{"/news/* /blog/:splat", "/news/2021/05/hello", "",
+			"/blog/2021/05/hello", true},
+		{"/news/* https://example.com/:splat", "/news/a", "",
+			"https://example.com/a", true},
+		// redirects pass the query string along
+		{"/old /new", "/old", "a=1", "/new?a=1", true},
+		// unless the target has its own
+		{"/old /new?b=2", "/old", "a=1", "/new?b=2", true},
+		// rewrites don't keep one at all
+		{"/app/* /index.html?x=1 200", "/app/page", "a=1", "/index.html", true},
+		// query conditions must all be present
+		{"/store id=:id /products/:id", "/store", "", "", false},
+		{"/store id=:id /products/:id", "/store", "id=5", "/products/5", true},
+		{"/store id=:id /products/:id", "/store", "id=5&x=1", "/products/5",
+			true},
+		{"/store id=:id lang=:lang /:lang/products/:id", "/store",
+			"id=5&lang=fr", "/fr/products/5", true},
+		{"/store id=:id lang=:lang /:lang/products/:id", "/store", "id=5", "",
+			false},
+		// a literal value must match exactly
+		{"/search q=go /go", "/search", "q=go", "/go", true},
+		{"/search q=go /go", "/search", "q=rust", "", false},
+	}
+	for _, tc := range tests {
+		r, err := parseRedirect(strings.Fields(tc.rule))
+		if err != nil {
+			t.Fatalf("parseRedirect(%q): %v", tc.rule, err)
+		}
+		query, _ := url.ParseQuery(tc.query)
+		target, ok := r.Match(tc.path, query)
+		if ok != tc.ok || target.Location != tc.location {
+			t.Errorf("%q.Match(%q, %q) = %q, %v; want %q, %v", tc.rule, tc.path,
+				tc.query, target.Location, ok, tc.location, tc.ok)
+		}
+	}
+}
+
+func TestMatchRedirects(t *testing.T) {
+	redirects, err := ParseRedirects(strings.NewReader(`
+/docs/old /docs/new 301!
+/docs/* /docs/index.html 200
+/* /404.html 404
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		path     string
+		location string
+		status   int
+		force    bool
+		rewrite  bool
+	}{
+		// the first match wins
+		{"/docs/old", "/docs/new", http.StatusMovedPermanently, true, false},
+		{"/docs/guide", "/docs/index.html", http.StatusOK, false, true},
+		{"/other", "/404.html", http.StatusNotFound, false, true},
+	}
+	for _, tc := range tests {
+		target, ok := MatchRedirects(redirects, tc.path, url.Values{})
+		if !ok || target.Location != tc.location || target.Status != tc.status ||
+			target.Force != tc.force || target.IsRewrite() != tc.rewrite {
+			t.Errorf("MatchRedirects(%q) = %+v, %v", tc.path, target, ok)
+		}
+	}
+	if _, ok := MatchRedirects(nil, "/docs/old", url.Values{}); ok {
+		t.Errorf("MatchRedirects with no rules matched")
+	}
+}